@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"gosub/data"
+	"gosub/validation"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (app *Config) AccountPage(w http.ResponseWriter, r *http.Request) {
+	app.renderAccount(w, r, nil)
+}
+
+// renderAccount renders the account page. The page holds several forms, so the
+// form with errors, if any, is passed back to show them next to its fields.
+func (app *Config) renderAccount(w http.ResponseWriter, r *http.Request, form *validation.Form) {
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["user"] = user
+
+	subscription, err := app.Models.Plan.GetSubscription(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.logError(r.Context(), err)
+	}
+	dataMap["subscription"] = subscription
+
+	prefs, err := app.Models.NotificationPreferences.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r.Context(), err)
+		prefs = data.DefaultNotificationPreferences(user.ID)
+	}
+	dataMap["preferences"] = prefs
+
+	sessions, err := app.Models.UserSession.GetActive(r.Context(), user.ID, time.Now().Add(-sessionLifetime))
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+	dataMap["sessions"] = sessions
+	dataMap["currentSession"] = app.Session.GetString(r.Context(), "sessionID")
+
+	app.render(w, r, "account.page.gohtml", &TemplateData{
+		Data: dataMap,
+		Form: form,
+	})
+}
+
+func (app *Config) PostAccountProfile(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("first-name", "last-name")
+	form.MaxLength("first-name", 255)
+	form.MaxLength("last-name", 255)
+
+	if !form.Valid() {
+		app.renderAccount(w, r, form)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	user.FirstName = strings.TrimSpace(form.Get("first-name"))
+	user.LastName = strings.TrimSpace(form.Get("last-name"))
+	err = user.Update(r.Context())
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to update user!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	if err = app.refreshSessionUser(r, user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditProfileUpdated,
+		TargetID: user.ID,
+	})
+
+	app.Session.Put(r.Context(), "flash", "Profile updated!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+func (app *Config) PostAccountPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot change the password while logged in as someone else!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("current-password", "password", "verify-password")
+	form.Password("password", app.Passwords, user.Email)
+	form.Matches("password", "verify-password", "Passwords do not match")
+
+	app.confirmPassword(r, form, "current-password", user)
+
+	if !form.Valid() {
+		app.renderAccount(w, r, form)
+		return
+	}
+
+	err = user.ResetPassword(r.Context(), form.Get("password"))
+	if err != nil {
+		var pwErr *validation.PasswordError
+		if errors.As(err, &pwErr) {
+			form.Errors.Add("password", pwErr.Message())
+			app.renderAccount(w, r, form)
+			return
+		}
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to change password!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditPasswordChanged,
+		TargetID: user.ID,
+	})
+
+	//whoever else knew the old password is signed out
+	if err = app.revokeOtherSessions(r, user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your password was changed!!",
+		Data:    "The password of your account was just changed. If it wasn't you, reset your password right away!!",
+	}
+	app.sendEmail(r.Context(), msg)
+
+	app.Session.Put(r.Context(), "flash", "Password changed, all your other sessions have been signed out!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+func (app *Config) PostAccountNotifications(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	prefs := data.NotificationPreferences{
+		UserID:           app.Session.GetInt(r.Context(), "userID"),
+		LoginAlerts:      r.Form.Get("login-alerts") == "on",
+		RenewalReminders: r.Form.Get("renewal-reminders") == "on",
+	}
+
+	err = prefs.Save(r.Context())
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to save preferences!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Notification preferences saved!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+// sendLoginAlert mails the user about a new login, if they asked for it
+func (app *Config) sendLoginAlert(r *http.Request, user *data.User) {
+	prefs, err := app.Models.NotificationPreferences.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r.Context(), err)
+		return
+	}
+
+	if !prefs.LoginAlerts {
+		return
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "New login to your account",
+		Data: "Your account was just logged in to from " + clientIP(r) + " (" + r.UserAgent() + "). " +
+			"If it wasn't you, reset your password right away!!",
+	}
+	app.sendEmail(r.Context(), msg)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/validation"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	//how long an activation link stays valid; a reminder or a resend gives a fresh one
+	activationLinkMinutes = 48 * 60
+	//how long the resend form waits before mailing the same address again
+	activationResendInterval = 5 * time.Minute
+)
+
+// ActivationPolicy says when accounts that were never activated are reminded,
+// and when they are deleted so the email address can register again
+type ActivationPolicy struct {
+	RemindAfter time.Duration
+	ExpireAfter time.Duration
+}
+
+// DefaultActivationPolicy returns the policy used when nothing is configured
+func DefaultActivationPolicy() ActivationPolicy {
+	return ActivationPolicy{
+		RemindAfter: 24 * time.Hour,
+		ExpireAfter: 7 * 24 * time.Hour,
+	}
+}
+
+// activationURL builds a signed activation link for the email
+func activationURL(email string) string {
+	link := fmt.Sprintf("http://localhost:8000/activate?email=%s", url.QueryEscape(email))
+	return GenerateTokenFromString(link)
+}
+
+// sendActivationEmail mails a fresh activation link to the user
+func (app *Config) sendActivationEmail(ctx context.Context, user *data.User, subject string) {
+	msg := Message{
+		To:       user.Email,
+		Subject:  subject,
+		Template: "confirmation-email",
+		Data:     template.HTML(activationURL(user.Email)),
+	}
+	app.sendEmail(ctx, msg)
+}
+
+func (app *Config) ResendActivationPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "resend-activation.page.gohtml", nil)
+}
+
+// PostResendActivationPage mails a new activation link. Like the forgot password
+// form, the answer does not tell whether the email is registered.
+func (app *Config) PostResendActivationPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		app.render(w, r, "resend-activation.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	//an account an admin deactivated cannot be activated again this way
+	user, err := app.Models.User.GetByEmail(r.Context(), strings.TrimSpace(form.Get("email")))
+	pending := false
+	if err == nil && user.Active == 0 {
+		pending, err = user.NeverActivated(r.Context())
+		if err != nil {
+			app.logError(r.Context(), err)
+		}
+	}
+	if pending {
+		first, err := app.firstActivationResend(user.Email)
+		if err != nil {
+			app.logError(r.Context(), err)
+		}
+		if first {
+			app.sendActivationEmail(r.Context(), user, "Activate your account!!")
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "If an inactive account exists for that email, we have sent a new activation link")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// firstActivationResend returns true if no link was resent to the email within
+// activationResendInterval, so the form cannot be used to flood an inbox
+func (app *Config) firstActivationResend(email string) (bool, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	key := "activation:resend:" + strings.ToLower(email)
+	_, err := redis.String(conn.Do("SET", key, 1, "NX", "PX", activationResendInterval.Milliseconds()))
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// remindInactiveAccounts mails a fresh activation link, once, to accounts that
+// have not been activated within RemindAfter
+func (app *Config) remindInactiveAccounts(ctx context.Context) error {
+	users, err := app.Models.User.GetUnreminded(ctx, time.Now().Add(-app.Activation.RemindAfter))
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		//too late to remind, the account is about to be purged
+		if time.Since(user.CreatedAt) >= app.Activation.ExpireAfter {
+			continue
+		}
+
+		err = user.MarkActivationReminded(ctx)
+		if err != nil {
+			app.logError(ctx, err)
+			continue
+		}
+
+		app.sendActivationEmail(ctx, user, "You have not activated your account yet!!")
+	}
+
+	return nil
+}
+
+// purgeInactiveAccounts deletes accounts that are still not activated after
+// ExpireAfter, which frees their email address to register again
+func (app *Config) purgeInactiveAccounts(ctx context.Context) error {
+	users, err := app.Models.User.GetExpiredInactive(ctx, time.Now().Add(-app.Activation.ExpireAfter))
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		err = user.DeleteAccount(ctx)
+		if err != nil {
+			app.logError(ctx, err)
+			continue
+		}
+
+		app.Logger.InfoContext(ctx, "Deleted inactive account", "deleted_user_id", user.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"gosub/data"
+	"net/http"
+	"strconv"
+)
+
+func (app *Config) AdminUsersPage(w http.ResponseWriter, r *http.Request) {
+	users, err := app.Models.User.GetAll(r.Context())
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to load users!!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["users"] = users
+
+	app.render(w, r, "admin-users.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// StartImpersonation logs the admin in as another user. The admin is kept in the
+// session as "impersonator" so that they can switch back with one click.
+func (app *Config) StartImpersonation(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	//get the admin from session
+	admin, ok := app.Session.Get(r.Context(), "user").(data.User)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "Log In first!!!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	//get the user to impersonate
+	id, _ := strconv.Atoi(r.Form.Get("id"))
+	target, err := app.Models.User.GetOne(r.Context(), id)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "No user found!!!")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if target.ID == admin.ID || target.IsAdmin == 1 {
+		app.Session.Put(r.Context(), "error", "You cannot log in as an admin!!")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	//record it before switching the session over
+	err = app.audit(r, data.AuditEvent{
+		ActorID:  admin.ID,
+		Action:   data.AuditImpersonationStart,
+		TargetID: target.ID,
+	})
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to record impersonation!!")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.RenewToken(r.Context())
+	app.rotateCSRFToken(r)
+	app.Session.Put(r.Context(), "impersonator", admin)
+	app.Session.Put(r.Context(), "userID", target.ID)
+	app.Session.Put(r.Context(), "user", *target)
+	app.Session.Put(r.Context(), "flash", "You are now logged in as "+target.Email)
+
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+// StopImpersonation puts the admin back in the session
+func (app *Config) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+	admin, ok := app.Session.Get(r.Context(), "impersonator").(data.User)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.recordImpersonationStop(r, admin)
+
+	app.Session.RenewToken(r.Context())
+	app.rotateCSRFToken(r)
+	app.Session.Remove(r.Context(), "impersonator")
+	app.Session.Put(r.Context(), "userID", admin.ID)
+	app.Session.Put(r.Context(), "user", admin)
+	app.Session.Put(r.Context(), "flash", "Welcome back "+admin.FirstName)
+
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+func (app *Config) recordImpersonationStop(r *http.Request, admin data.User) {
+	_ = app.audit(r, data.AuditEvent{
+		ActorID:  admin.ID,
+		Action:   data.AuditImpersonationStop,
+		TargetID: app.Session.GetInt(r.Context(), "userID"),
+	})
+}
+
+func (app *Config) AdminSettingsPage(w http.ResponseWriter, r *http.Request) {
+	dataMap := make(map[string]any)
+	dataMap["requireAdminTwoFactor"] = app.adminTwoFactorRequired(r.Context())
+
+	app.render(w, r, "admin-settings.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) PostAdminSettingsPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	value := "false"
+	if r.Form.Get("require-admin-2fa") == "on" {
+		value = "true"
+	}
+
+	err = app.Models.Setting.Set(r.Context(), data.SettingRequireAdminTwoFactor, value)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to save settings!!")
+		http.Redirect(w, r, "/admin/settings", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:  data.AuditSettingChanged,
+		Payload: map[string]any{"key": data.SettingRequireAdminTwoFactor, "value": value},
+	})
+
+	app.Session.Put(r.Context(), "flash", "Settings saved!!")
+	http.Redirect(w, r, "/admin/settings", http.StatusSeeOther)
+}
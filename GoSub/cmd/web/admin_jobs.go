@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"gosub/data"
+	"net/http"
+	"strconv"
+)
+
+// AdminJobsPage lists the newest background jobs, optionally of one status
+func (app *Config) AdminJobsPage(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+
+	jobs, err := app.Models.Job.GetAll(r.Context(), status)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to load jobs!!")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["jobs"] = jobs
+	dataMap["statuses"] = data.JobStatuses
+	dataMap["status"] = status
+
+	app.render(w, r, "admin-jobs.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// PostRetryJob queues a failed job again
+func (app *Config) PostRetryJob(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+
+	err = app.Models.Job.Retry(r.Context(), id)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r.Context(), err)
+		}
+		app.Session.Put(r.Context(), "error", "Unable to retry job!!")
+		http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Job queued again!!")
+	http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+}
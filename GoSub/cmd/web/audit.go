@@ -0,0 +1,84 @@
+package main
+
+import (
+	"gosub/data"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// audit fills in the request details of an event and writes it to the audit log.
+// When no actor is given, the user in the session is used.
+func (app *Config) audit(r *http.Request, event data.AuditEvent) error {
+	if event.ActorID == 0 {
+		event.ActorID = app.Session.GetInt(r.Context(), "userID")
+	}
+
+	if event.Payload == nil {
+		event.Payload = make(map[string]any)
+	}
+
+	//keep track of who was really behind an impersonated session
+	if admin, ok := app.Session.Get(r.Context(), "impersonator").(data.User); ok {
+		event.Payload["impersonator_id"] = admin.ID
+	}
+
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+
+	_, err := app.Models.AuditEvent.Insert(r.Context(), event)
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+	return err
+}
+
+// clientIP returns the remote address without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (app *Config) AdminAuditPage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := data.AuditFilter{
+		Action: query.Get("action"),
+	}
+	filter.ActorID, _ = strconv.Atoi(query.Get("actor"))
+	filter.TargetID, _ = strconv.Atoi(query.Get("target"))
+	if from, err := time.Parse("2006-01-02", query.Get("from")); err == nil {
+		filter.From = from
+	}
+	if to, err := time.Parse("2006-01-02", query.Get("to")); err == nil {
+		//include the whole day
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	events, err := app.Models.AuditEvent.GetAll(r.Context(), filter)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to load audit events!!")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["events"] = events
+	dataMap["actions"] = data.AuditActions
+	dataMap["filter"] = map[string]string{
+		"action": query.Get("action"),
+		"actor":  query.Get("actor"),
+		"target": query.Get("target"),
+		"from":   query.Get("from"),
+		"to":     query.Get("to"),
+	}
+
+	app.render(w, r, "admin-audit.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
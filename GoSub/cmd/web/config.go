@@ -3,19 +3,37 @@ package main
 import (
 	"database/sql"
 	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gosub/data"
-	"log"
+	"gosub/reporting"
+	"gosub/storage"
+	"gosub/validation"
+	"log/slog"
+	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
 type Config struct {
 	Session       *scs.SessionManager
 	DB            *sql.DB
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
+	Redis         *redis.Pool
+	Logger        *slog.Logger
 	Wait          *sync.WaitGroup
 	Models        data.Models
+	Passwords     *validation.PasswordPolicy
 	Mailer        Mail
+	Jobs          *JobQueue
+	Scheduler     *Scheduler
 	ErrorChan     chan error
 	ErrorChanDone chan bool
+	Activation    ActivationPolicy
+	Manuals       *ManualLayouts
+	Blobs         storage.BlobStore
+	Server        *http.Server
+	AdminServer   *http.Server
+	Tracer        *sdktrace.TracerProvider
+	Errors        *reporting.Reporter
+	Draining      atomic.Bool //set on shutdown, so readiness fails
 }
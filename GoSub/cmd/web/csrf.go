@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	csrfSessionKey = "csrfToken"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// VerifyCSRF rejects state-changing requests that do not carry the
+// token stored in the session of the user
+func (app *Config) VerifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfSessionKey)
+
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue(csrfFormField)
+		}
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(sent)) != 1 {
+			app.Logger.WarnContext(r.Context(), "Invalid CSRF token", "method", r.Method, "path", r.URL.Path)
+			app.errorPage(w, r, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the token of the session, creating one if needed
+func (app *Config) csrfToken(r *http.Request) string {
+	token := app.Session.GetString(r.Context(), csrfSessionKey)
+	if token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		app.logError(r.Context(), err)
+		return ""
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(r.Context(), csrfSessionKey, token)
+	return token
+}
+
+// rotateCSRFToken drops the token, so a new one is made for the next page.
+// It is called whenever the user in the session changes.
+func (app *Config) rotateCSRFToken(r *http.Request) {
+	app.Session.Remove(r.Context(), csrfSessionKey)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/storage"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/phpdave11/gofpdf"
+)
+
+const (
+	//how long a call to the blob store may take
+	blobTimeout = 30 * time.Second
+	//where a local blob store serves its signed links
+	localBlobsPath = "/files"
+	//download links only need to last until the browser follows the redirect
+	downloadLinkExpiry = 5 * time.Minute
+	//invoices are kept in the blob store under this prefix
+	invoicesPrefix = "invoices/"
+)
+
+// DocumentsPage lists the manuals of every plan the user has subscribed to, and
+// their invoices
+func (app *Config) DocumentsPage(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	manuals, err := app.manualPlans(r.Context(), userID)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to load your documents!!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	invoices, err := app.Models.Invoice.GetAllForUser(r.Context(), userID)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to load your documents!!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	//newest first
+	for i, j := 0, len(invoices)-1; i < j; i, j = i+1, j-1 {
+		invoices[i], invoices[j] = invoices[j], invoices[i]
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["manuals"] = manuals
+	dataMap["invoices"] = invoices
+
+	app.render(w, r, "documents.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// manualPlans returns the plans the user has, or has had, a manual for. The
+// current plan comes first.
+func (app *Config) manualPlans(ctx context.Context, userID int) ([]*data.Plan, error) {
+	var plans []*data.Plan
+	seen := make(map[int]bool)
+
+	subscription, err := app.Models.Plan.GetSubscription(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if subscription != nil {
+		plans = append(plans, &subscription.Plan)
+		seen[subscription.Plan.ID] = true
+	}
+
+	history, err := app.Models.SubscriptionRecord.GetHistory(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		if seen[history[i].PlanID] {
+			continue
+		}
+		seen[history[i].PlanID] = true
+
+		plan, err := app.Models.Plan.GetOne(ctx, history[i].PlanID)
+		if errors.Is(err, sql.ErrNoRows) {
+			//the plan is gone, and so is its manual
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// DownloadManual sends the user to a short lived link to the manual of a plan
+// they have subscribed to. It is generated again if it is not cached anymore.
+func (app *Config) DownloadManual(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/documents", http.StatusSeeOther)
+		return
+	}
+
+	planID, _ := strconv.Atoi(r.URL.Query().Get("plan"))
+
+	plans, err := app.manualPlans(r.Context(), user.ID)
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	var plan *data.Plan
+	for _, p := range plans {
+		if p.ID == planID {
+			plan = p
+		}
+	}
+	if plan == nil {
+		app.Session.Put(r.Context(), "error", "Document not found!!")
+		http.Redirect(w, r, "/members/documents", http.StatusSeeOther)
+		return
+	}
+
+	key, err := app.manualFor(r.Context(), *user, plan)
+	if err == nil {
+		err = app.redirectToBlob(w, r, key, plan.PlanName+"-manual.pdf")
+	}
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to get the manual, please try again later!!")
+		http.Redirect(w, r, "/members/documents", http.StatusSeeOther)
+	}
+}
+
+// DownloadInvoice sends the user to a short lived link to one of their invoices
+func (app *Config) DownloadInvoice(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+
+	invoice, err := app.Models.Invoice.GetOne(r.Context(), id)
+	if err != nil || invoice.UserID != app.Session.GetInt(r.Context(), "userID") {
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r.Context(), err)
+		}
+		app.Session.Put(r.Context(), "error", "Document not found!!")
+		http.Redirect(w, r, "/members/documents", http.StatusSeeOther)
+		return
+	}
+
+	key, err := app.invoiceFor(r.Context(), invoice)
+	if err == nil {
+		err = app.redirectToBlob(w, r, key, fmt.Sprintf("invoice-%d.pdf", invoice.ID))
+	}
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to get the invoice, please try again later!!")
+		http.Redirect(w, r, "/members/documents", http.StatusSeeOther)
+	}
+}
+
+// redirectToBlob sends the browser to a signed link that downloads the blob as
+// filename. Nothing is written when it fails.
+func (app *Config) redirectToBlob(w http.ResponseWriter, r *http.Request, key, filename string) error {
+	link, err := app.Blobs.SignedURL(r.Context(), key, filename, downloadLinkExpiry)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, link, http.StatusSeeOther)
+	return nil
+}
+
+// invoiceKey is where the PDF of an invoice is kept in the blob store
+func invoiceKey(id int) string {
+	return fmt.Sprintf("%s%d.pdf", invoicesPrefix, id)
+}
+
+// invoiceFor returns the key of the PDF of the invoice in the blob store. An
+// invoice does not change, so the PDF is generated once.
+func (app *Config) invoiceFor(ctx context.Context, invoice *data.Invoice) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, blobTimeout)
+	defer cancel()
+
+	key := invoiceKey(invoice.ID)
+
+	_, err := app.Blobs.Stat(ctx, key)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+
+	buf, err := app.renderInvoice(ctx, invoice)
+	if err != nil {
+		return "", err
+	}
+
+	if err = app.Blobs.Put(ctx, key, buf, int64(buf.Len()), "application/pdf"); err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// renderInvoice writes out the PDF of the invoice, in a span of its own
+func (app *Config) renderInvoice(ctx context.Context, invoice *data.Invoice) (buf *bytes.Buffer, err error) {
+	_, span := tracer.Start(ctx, "pdf.invoice")
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	buf = &bytes.Buffer{}
+	if err = app.generateInvoice(invoice).Output(buf); err != nil {
+		return nil, err
+	}
+	pdfDuration.WithLabelValues("invoice").Observe(time.Since(start).Seconds())
+
+	return buf, nil
+}
+
+// readBlob reads a whole blob, to attach it to a mail
+func (app *Config) readBlob(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, blobTimeout)
+	defer cancel()
+
+	return storage.ReadAll(ctx, app.Blobs, key)
+}
+
+// generateInvoice lays out an invoice record as a one page PDF
+func (app *Config) generateInvoice(invoice *data.Invoice) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "B", 20)
+	pdf.Cell(0, 12, fmt.Sprintf("Invoice #%d", invoice.ID))
+	pdf.Ln(16)
+
+	pdf.SetFont("Arial", "", 11)
+	pdf.Cell(0, 6, "Date: "+invoice.CreatedAt.Format("January 2, 2006"))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, "Billed to: "+invoice.BillingName)
+	pdf.Ln(6)
+	pdf.Cell(0, 6, invoice.BillingEmail)
+	pdf.Ln(14)
+
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(120, 8, "Description", "B", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 8, "Amount", "B", 1, "R", false, 0, "")
+
+	pdf.SetFont("Arial", "", 11)
+	pdf.CellFormat(120, 8, invoice.PlanName+" plan, monthly subscription", "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 8, invoice.AmountForDisplay(), "", 1, "R", false, 0, "")
+
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(120, 8, "Total", "T", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 8, invoice.AmountForDisplay(), "T", 1, "R", false, 0, "")
+
+	return pdf
+}
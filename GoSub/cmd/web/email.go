@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/validation"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const emailChangeLinkMinutes = 60
+
+func (app *Config) ChangeEmailPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "change-email.page.gohtml", nil)
+}
+
+// PostChangeEmailPage does not change anything yet. It mails a signed link to the
+// new address and a notice to the old one; the change happens in ConfirmEmailChange.
+func (app *Config) PostChangeEmailPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	form.MaxLength("email", 255)
+
+	newEmail := strings.TrimSpace(form.Get("email"))
+	if form.Has("email") && strings.EqualFold(newEmail, user.Email) {
+		form.Errors.Add("email", "This is already your email address")
+	}
+
+	app.confirmPassword(r, form, "password", user)
+
+	if form.Valid() {
+		if _, err := app.Models.User.GetByEmail(r.Context(), newEmail); err == nil {
+			form.Errors.Add("email", "An account with this email already exists")
+		}
+	}
+
+	if !form.Valid() {
+		app.render(w, r, "change-email.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	link, err := app.emailChangeURL(r.Context(), user, newEmail)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to change the email address, try again")
+		http.Redirect(w, r, "/members/email", http.StatusSeeOther)
+		return
+	}
+
+	//ask the new address to confirm
+	msg := Message{
+		To:       newEmail,
+		Subject:  "Confirm your new email address!!",
+		Template: "change-email",
+		Data:     template.HTML(link),
+	}
+	app.sendEmail(r.Context(), msg)
+
+	//and warn the old one
+	msg = Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed!!",
+		Data: fmt.Sprintf("Someone asked to change the email address of your account to %s. "+
+			"Nothing changes until the new address is confirmed. If it wasn't you, change your password!!", newEmail),
+	}
+	app.sendEmail(r.Context(), msg)
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditEmailChangeRequest,
+		TargetID: user.ID,
+		Payload:  map[string]any{"old_email": user.Email, "new_email": newEmail},
+	})
+
+	app.Session.Put(r.Context(), "flash", "We have sent a confirmation link to "+newEmail)
+	http.Redirect(w, r, "/members/email", http.StatusSeeOther)
+}
+
+// ConfirmEmailChange applies the change once the link sent to the new address is opened
+func (app *Config) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("http://localhost:8000%s", r.RequestURI)
+	if !VerifyToken(testUrl) || Expired(testUrl, emailChangeLinkMinutes) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	token, err := app.Models.LinkToken.Use(r.Context(), data.LinkEmailChange, r.URL.Query().Get("token"))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r.Context(), err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), token.UserID)
+	if err != nil || emailVersion(user.Email) != token.Payload["v"] {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	oldEmail := user.Email
+	user.Email = token.Payload["email"]
+	err = user.Update(r.Context())
+	if err != nil {
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			app.Session.Put(r.Context(), "error", "An account with this email already exists")
+		} else {
+			app.logError(r.Context(), err)
+			app.Session.Put(r.Context(), "error", "Unable to update user!!")
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		ActorID:  user.ID,
+		Action:   data.AuditEmailChanged,
+		TargetID: user.ID,
+		Payload:  map[string]any{"old_email": oldEmail, "new_email": user.Email},
+	})
+
+	//the link may be opened in the browser the user is logged in with
+	if app.Session.GetInt(r.Context(), "userID") == user.ID {
+		if err = app.refreshSessionUser(r, user.ID); err != nil {
+			app.logError(r.Context(), err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your email address has been changed!!")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// emailChangeURL issues the token that confirms the change to newEmail, and builds
+// the signed link that carries it. The new address stays on the server side.
+func (app *Config) emailChangeURL(ctx context.Context, user *data.User, newEmail string) (string, error) {
+	token, err := app.Models.LinkToken.Issue(ctx, user.ID, data.LinkEmailChange,
+		map[string]string{"email": newEmail, "v": emailVersion(user.Email)}, emailChangeLinkMinutes*time.Minute)
+	if err != nil {
+		return "", err
+	}
+
+	link := fmt.Sprintf("http://localhost:8000/confirm-email?token=%s", token)
+	return GenerateTokenFromString(link), nil
+}
+
+// emailVersion fingerprints the current address. It is kept with the token, so a
+// link stops working once the email has been changed in any other way.
+func emailVersion(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(sum[:8])
+}
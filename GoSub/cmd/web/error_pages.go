@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"gosub/reporting"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// what the error pages tell the user; the details of an error only go to the logs
+var errorPageMessages = map[int]string{
+	http.StatusForbidden:           "You are not allowed to do that. If you were sending a form, reload the page and try again.",
+	http.StatusNotFound:            "The page you are looking for does not exist.",
+	http.StatusMethodNotAllowed:    "This page can not be used like that.",
+	http.StatusInternalServerError: "Something went wrong on our side. Please try again later.",
+}
+
+// errorPage renders the page of the status through the base layout. A server
+// error page shows the request id, so a report from the user can be matched with
+// the logs.
+func (app *Config) errorPage(w http.ResponseWriter, r *http.Request, status int) {
+	app.errorPageWith(w, r, status, "")
+}
+
+// errorPageWith renders the page of the status with its own message, or the one
+// of the status if it is empty
+func (app *Config) errorPageWith(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if message == "" {
+		message = errorPageMessages[status]
+	}
+
+	dataMap := map[string]any{
+		"status":  status,
+		"title":   http.StatusText(status),
+		"message": message,
+	}
+	if status >= http.StatusInternalServerError {
+		dataMap["reference"] = middleware.GetReqID(r.Context())
+	}
+
+	var buf bytes.Buffer
+	if err := app.renderTo(&buf, r, "error.page.gohtml", &TemplateData{Data: dataMap}); err != nil {
+		//the page itself is broken, fall back to the plain status
+		app.logError(r.Context(), err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// serverError logs err and renders the server error page, without err
+func (app *Config) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r.Context(), err)
+	app.errorPage(w, r, http.StatusInternalServerError)
+}
+
+func (app *Config) NotFound(w http.ResponseWriter, r *http.Request) {
+	app.errorPage(w, r, http.StatusNotFound)
+}
+
+func (app *Config) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	app.errorPage(w, r, http.StatusMethodNotAllowed)
+}
+
+// Recoverer turns a panic of a handler into the server error page, and reports
+// the panic with its stack
+func (app *Config) Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				//net/http aborts the response quietly
+				panic(p)
+			}
+
+			err := reporting.Recovered(p)
+			app.logError(r.Context(), err)
+			app.errorPage(w, r, http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
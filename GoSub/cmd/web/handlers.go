@@ -1,15 +1,17 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"gosub/data"
+	"gosub/validation"
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/phpdave11/gofpdf"
-	"github.com/phpdave11/gofpdf/contrib/gofpdi"
 )
 
 func (app *Config) HomePage(w http.ResponseWriter, r *http.Request) {
@@ -26,23 +28,49 @@ func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	//parse form data
 	err := r.ParseForm()
 	if err != nil {
-		app.ErrorLog.Println(err)
+		app.logError(r.Context(), err)
+	}
+
+	//validate form data
+	form := validation.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		app.render(w, r, "login.page.gohtml", &TemplateData{Form: form})
+		return
 	}
 
 	//get form data
-	email := r.Form.Get("email")
-	password := r.Form.Get("password")
+	email := strings.TrimSpace(form.Get("email"))
+	password := form.Get("password")
 
-	//check if user exists
-	user, err := app.Models.User.GetByEmail(email)
+	//slow down repeated failures for this account or address
+	wait, err := app.loginWait(email, clientIP(r))
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Email Don't exist")
+		app.logError(r.Context(), err)
+	}
+	if wait > 0 {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Too many failed login attempts. Try again in %s", formatWait(wait)))
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
+	//check if user exists
+	user, err := app.Models.User.GetByEmail(r.Context(), email)
+	if err != nil {
+		_ = app.audit(r, data.AuditEvent{
+			Action:  data.AuditLoginFailed,
+			Payload: map[string]any{"email": email, "reason": "unknown email"},
+		})
+		app.loginFailedAttempt(r, email, nil)
+		form.Errors.Add("email", "Email Don't exist")
+		app.render(w, r, "login.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
 	//check if password is correct
-	match, err := user.PasswordMatches(password)
+	match, err := user.PasswordMatches(r.Context(), password)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Invalid credentials")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -50,32 +78,156 @@ func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !match {
-		msg := Message{
-			To:      email,
-			Subject: "Failed login attempt!!",
-			Data:    "InvalidLoginAttempt!!",
-		}
-		app.sendEmail(msg)
-		app.Session.Put(r.Context(), "error", "Wrong password!!")
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		_ = app.audit(r, data.AuditEvent{
+			Action:   data.AuditLoginFailed,
+			TargetID: user.ID,
+			Payload:  map[string]any{"email": email, "reason": "wrong password"},
+		})
+		app.loginFailedAttempt(r, email, user)
+		form.Errors.Add("password", "Wrong password!!")
+		app.render(w, r, "login.page.gohtml", &TemplateData{Form: form})
 		return
 	}
 
 	//check if user is active
 	if user.Active == 0 {
-		app.Session.Put(r.Context(), "error", "Account not activated!!")
+		app.Session.Put(r.Context(), "error", "Account not activated!! Check your email, or ask for a new activation link below")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
+	//ask for the second factor before logging the user in
+	if user.TwoFactorEnabled == 1 {
+		app.Session.Put(r.Context(), "twoFactorUserID", user.ID)
+		app.Session.Put(r.Context(), "twoFactorStarted", time.Now().Unix())
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.completeLogin(w, r, user, "password")
+}
+
+// completeLogin puts the user in the session once every check has passed
+func (app *Config) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User, method string) {
+	if err := app.resetLoginFailures(user.Email); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	app.rotateCSRFToken(r)
 	app.Session.Put(r.Context(), "userID", user.ID)
-	app.Session.Put(r.Context(), "user", user)
+	app.Session.Put(r.Context(), "user", *user)
+	app.startUserSession(r, user)
 	app.Session.Put(r.Context(), "flash", "Login successful")
 
+	if user.IsAdmin == 1 && user.TwoFactorEnabled != 1 && app.adminTwoFactorRequired(r.Context()) {
+		app.Session.Put(r.Context(), "warning", "Admins must set up two-factor authentication before using the admin area")
+	}
+
+	if user.DeleteAfter != nil {
+		app.Session.Put(r.Context(), "warning", "Your account will be deleted on "+user.DeleteAfter.Format("January 2, 2006")+
+			". You can cancel this from your account page.")
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditLogin,
+		TargetID: user.ID,
+		Payload:  map[string]any{"method": method},
+	})
+
+	app.sendLoginAlert(r, user)
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// loginFailedAttempt counts a failed login, and when it locks the account
+// it mails the owner a link to unlock it
+func (app *Config) loginFailedAttempt(r *http.Request, email string, user *data.User) {
+	locked, err := app.loginFailed(email, clientIP(r))
+	if err != nil {
+		app.logError(r.Context(), err)
+		return
+	}
+
+	if !locked || user == nil {
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditLocked,
+		TargetID: user.ID,
+	})
+
+	//send unlock email
+	token, err := app.Models.LinkToken.Issue(r.Context(), user.ID, data.LinkUnlock, nil, unlockLinkMinutes*time.Minute)
+	if err != nil {
+		app.logError(r.Context(), err)
+		return
+	}
+	link := fmt.Sprintf("http://localhost:8000/unlock?token=%s", token)
+	signedUrl := GenerateTokenFromString(link)
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  "Your account has been locked!!",
+		Template: "unlock-email",
+		Data:     template.HTML(signedUrl),
+	}
+
+	app.sendEmail(r.Context(), msg)
+}
+
+func (app *Config) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	//valid url token
+	uri := r.RequestURI
+	testUrl := fmt.Sprintf("http://localhost:8000%s", uri)
+	if !VerifyToken(testUrl) || Expired(testUrl, unlockLinkMinutes) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired token")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	token, err := app.Models.LinkToken.Use(r.Context(), data.LinkUnlock, r.URL.Query().Get("token"))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r.Context(), err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid or expired token")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), token.UserID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "No user found!!!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err = app.resetLoginFailures(user.Email); err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to unlock account!!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		ActorID:  user.ID,
+		Action:   data.AuditUnlocked,
+		TargetID: user.ID,
+	})
+
+	app.Session.Put(r.Context(), "flash", "Account unlocked, you can log in again!!")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
 func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	//close any impersonation before the session is gone
+	if admin, ok := app.Session.Get(r.Context(), "impersonator").(data.User); ok {
+		app.recordImpersonationStop(r, admin)
+	}
+
+	app.endUserSession(r)
+
 	//clean up session
 	app.Session.Destroy(r.Context())
 	app.Session.RenewToken(r.Context())
@@ -91,39 +243,55 @@ func (app *Config) RegisterPage(w http.ResponseWriter, r *http.Request) {
 func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		app.ErrorLog.Println(err)
+		app.logError(r.Context(), err)
+	}
+
+	//validate form data
+	form := validation.New(r.PostForm)
+	form.Required("email", "password", "verify-password", "first-name", "last-name")
+	form.IsEmail("email")
+	form.MaxLength("email", 255)
+	form.MaxLength("first-name", 255)
+	form.MaxLength("last-name", 255)
+	form.Password("password", app.Passwords, form.Get("email"))
+	form.Matches("password", "verify-password", "Passwords do not match")
+
+	if !form.Valid() {
+		app.render(w, r, "register.page.gohtml", &TemplateData{Form: form})
+		return
 	}
+
 	//create a user
 	user := data.User{
-		FirstName: r.Form.Get("first-name"),
-		LastName:  r.Form.Get("last-name"),
-		Email:     r.Form.Get("email"),
-		Password:  r.Form.Get("password"),
+		FirstName: strings.TrimSpace(form.Get("first-name")),
+		LastName:  strings.TrimSpace(form.Get("last-name")),
+		Email:     strings.TrimSpace(form.Get("email")),
+		Password:  form.Get("password"),
 		Active:    0,
 		IsAdmin:   0,
 	}
 
-	_, err = user.Insert(user)
+	_, err = user.Insert(r.Context(), user)
 	if err != nil {
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			form.Errors.Add("email", "An account with this email already exists")
+			app.render(w, r, "register.page.gohtml", &TemplateData{Form: form})
+			return
+		}
+		var pwErr *validation.PasswordError
+		if errors.As(err, &pwErr) {
+			form.Errors.Add("password", pwErr.Message())
+			app.render(w, r, "register.page.gohtml", &TemplateData{Form: form})
+			return
+		}
+		app.logError(r.Context(), err)
 		app.Session.Put(r.Context(), "error", "Failed to create user")
 		http.Redirect(w, r, "/register", http.StatusSeeOther)
 		return
 	}
 
 	//send activation email
-	url := fmt.Sprintf("http://localhost:8000/activate?email=%s", user.Email)
-	signedUrl := GenerateTokenFromString(url)
-
-	//make email
-	msg := Message{
-		To:       user.Email,
-		Subject:  "Activate your account!!",
-		Template: "confirmation-email",
-		Data:     template.HTML(signedUrl),
-	}
-
-	//send email
-	app.sendEmail(msg)
+	app.sendActivationEmail(r.Context(), &user, "Activate your account!!")
 
 	//update session
 	app.Session.Put(r.Context(), "flash", "Account created successfully. Please check your email to activate your account")
@@ -142,36 +310,61 @@ func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	if Expired(testUrl, activationLinkMinutes) {
+		app.Session.Put(r.Context(), "error", "This activation link has expired, ask for a new one!!")
+		http.Redirect(w, r, "/activate/resend", http.StatusSeeOther)
+		return
+	}
 
 	//get email from url
-	user, err := app.Models.User.GetByEmail(r.URL.Query().Get("email"))
+	user, err := app.Models.User.GetByEmail(r.Context(), r.URL.Query().Get("email"))
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "No user found!!!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
+	//an account an admin deactivated stays deactivated
+	if user.Active == 0 {
+		pending, err := user.NeverActivated(r.Context())
+		if err != nil || !pending {
+			app.Session.Put(r.Context(), "error", "This account cannot be activated!!")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+	}
+
 	//update user
-	user.Active = 1
-	err = user.Update()
+	err = user.Activate(r.Context())
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Unable to update user!!")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
 
+	_ = app.audit(r, data.AuditEvent{
+		ActorID:  user.ID,
+		Action:   data.AuditActivated,
+		TargetID: user.ID,
+	})
+
 	app.Session.Put(r.Context(), "flash", "Account activated successfully!!")
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 
 }
 
 func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
 	//get the id of the plan
-	id := r.URL.Query().Get("id")
+	id := r.Form.Get("id")
 	planID, _ := strconv.Atoi(id)
 
 	//get the plan from datbase
-	plan, err := app.Models.Plan.GetOne(planID)
+	plan, err := app.Models.Plan.GetOne(r.Context(), planID)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Unable to find plan!!")
 		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
@@ -186,81 +379,61 @@ func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//generate an invoice and send it via mail
-	app.Wait.Add(1)
-	go (func() {
-		defer app.Wait.Done()
+	//subscribe user to plan
+	err = app.Models.Plan.SubscribeUserToPlan(r.Context(), user, *plan)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error subscribing to plan!!")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
 
-		invoice, err := app.getInvoice(user, plan)
+	//record the invoice, and mail it from a job
+	invoiceID, err := app.createInvoice(r.Context(), user, plan)
+	if err != nil {
+		app.logError(r.Context(), err)
+	} else {
+		_, err = app.Jobs.Enqueue(r.Context(), jobInvoiceMail, invoiceMailPayload{InvoiceID: invoiceID}, JobOptions{
+			UniqueKey: strconv.Itoa(invoiceID),
+		})
 		if err != nil {
-			//send this to a channel
-			app.ErrorChan <- err
-		}
-
-		msg := Message{
-			To:       user.Email,
-			Subject:  "Your Invoice",
-			Data:     invoice,
-			Template: "invoice",
+			app.logError(r.Context(), err)
 		}
-
-		app.sendEmail(msg)
-	})()
+	}
 
 	//generate a manual
-	app.Wait.Add(1)
-	go (func() {
-		defer app.Wait.Done()
-
-		manual := app.generateManual(user, plan)
-		err := manual.OutputFileAndClose(fmt.Sprintf("./tmp/%d_manual.pdf", user.ID))
-		if err != nil {
-			//send this to a channel
-			app.ErrorChan <- err
-			return
-		}
-
-		msg := Message{
-			To:      user.Email,
-			Subject: "Your Manual",
-			Data:    "Your manual is attached",
-			AttachmentsMap: map[string]string{
-				"manual.pdf": fmt.Sprintf("./tmp/%d_manual.pdf", user.ID),
-			},
-		}
-
-		app.sendEmail(msg)
-
-		//test app error chan
-		//app.ErrorChan <- fmt.Errorf("test error")
-	})()
+	_, err = app.Jobs.Enqueue(r.Context(), jobManual, manualPayload{UserID: user.ID, PlanID: plan.ID}, JobOptions{
+		UniqueKey: fmt.Sprintf("%d:%d", user.ID, plan.ID),
+	})
+	if err != nil && !errors.Is(err, data.ErrDuplicateJob) {
+		app.logError(r.Context(), err)
+	}
 
-	//subscribe user to plan
-	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
-	if err != nil {
-		app.Session.Put(r.Context(), "error", "Error subscribing to plan!!")
-		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
-		return
+	payload := map[string]any{"plan_id": plan.ID, "plan_name": plan.PlanName}
+	if user.Plan != nil {
+		payload["previous_plan_id"] = user.Plan.ID
 	}
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditPlanChanged,
+		TargetID: user.ID,
+		Payload:  payload,
+	})
 
-	u, err := app.Models.User.GetOne(user.ID)
+	err = app.refreshSessionUser(r, user.ID)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
 		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 		return
 	}
 
-	app.Session.Put(r.Context(), "user", u)
-
 	//redirect
 	app.Session.Put(r.Context(), "flash", "You have subscribed to a plan!!")
 	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 }
 
 func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
-	plans, err := app.Models.Plan.GetAll()
+	plans, err := app.Models.Plan.GetAll(r.Context())
 	if err != nil {
-		app.ErrorLog.Println(err)
+		app.serverError(w, r, err)
 		return
 	}
 
@@ -274,28 +447,14 @@ func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
 
 ///////////////////////////////UTILITIES///////////////////////////////////////
 
-func (app *Config) generateManual(user data.User, plan *data.Plan) *gofpdf.Fpdf {
-	pdf := gofpdf.New("P", "mm", "Letter", "")
-	pdf.SetMargins(10, 13, 10)
-	importer := gofpdi.NewImporter()
-	//let take some time to make sure the file is imported
-	time.Sleep(5 * time.Second)
-
-	tmpl := importer.ImportPage(pdf, "./pdf/manual.pdf", 1, "/MediaBox")
-	pdf.AddPage()
-
-	importer.UseImportedTemplate(pdf, tmpl, 0, 0, 215.9, 0)
-
-	pdf.SetX(75)
-	pdf.SetY(150)
-	pdf.SetFont("Arial", "B", 12)
-	pdf.MultiCell(0, 4, fmt.Sprintf("%s %s", user.FirstName, user.LastName), "", "C", false)
-	pdf.Ln(5)
-	pdf.MultiCell(0, 4, fmt.Sprintf("%s User Guide", plan.PlanName), "", "C", false)
-
-	return pdf
-}
-
-func (app *Config) getInvoice(user data.User, plan *data.Plan) (string, error) {
-	return plan.PlanAmountFormatted, nil
+// createInvoice records the invoice of the subscription, and returns its id
+func (app *Config) createInvoice(ctx context.Context, user data.User, plan *data.Plan) (int, error) {
+	return app.Models.Invoice.Insert(ctx, data.Invoice{
+		UserID:       user.ID,
+		PlanID:       plan.ID,
+		PlanName:     plan.PlanName,
+		Amount:       plan.PlanAmount,
+		BillingName:  fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		BillingEmail: user.Email,
+	})
 }
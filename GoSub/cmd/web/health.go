@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+const (
+	//every readiness check gives up after this long
+	readinessTimeout = 2 * time.Second
+	//how long readiness fails before the server stops, so the load balancer
+	//notices and sends no more requests
+	drainDelay = 5 * time.Second
+	//how long the requests in flight get to finish on shutdown
+	shutdownTimeout = 30 * time.Second
+	//how long the result of the checks is reused for the public readiness probe
+	readinessCacheTTL = time.Second
+)
+
+// readinessCheck reports whether a dependency of the app can be reached
+type readinessCheck func(ctx context.Context) error
+
+// Probes answers the liveness and readiness probes before the other middleware,
+// so the probes neither load a session nor show up in the request logs. The
+// readiness probe of the site only tells the status, the checks are on the
+// admin address.
+func (app *Config) Probes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			switch r.URL.Path {
+			case "/healthz":
+				app.Healthz(w, r)
+				return
+			case "/readyz":
+				app.PublicReadyz(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Healthz reports that the process is alive
+func (app *Config) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// readiness is the last result of the checks, reused by the public readiness
+// probe so that anyone hitting it does not open connections to every dependency
+var readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	ready   bool
+}
+
+// PublicReadyz reports whether the app can serve requests, without the checks
+// and their errors. The checks run at most once per readinessCacheTTL.
+func (app *Config) PublicReadyz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	resp := struct {
+		Status string `json:"status"`
+	}{Status: "ready"}
+
+	if app.Draining.Load() {
+		status = http.StatusServiceUnavailable
+		resp.Status = "shutting down"
+	} else if !app.cachedReadiness(r.Context()) {
+		status = http.StatusServiceUnavailable
+		resp.Status = "not ready"
+	}
+
+	writeReadiness(w, status, resp)
+}
+
+// cachedReadiness runs the checks when their last result is too old. Requests
+// coming in meanwhile wait for it instead of running the checks again.
+func (app *Config) cachedReadiness(ctx context.Context) bool {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+
+	if time.Since(readiness.checked) < readinessCacheTTL {
+		return readiness.ready
+	}
+
+	//the result is shared, so it does not depend on the request going away
+	ctx = context.WithoutCancel(ctx)
+
+	ready := true
+	for name, err := range app.checkReadiness(ctx) {
+		if err != nil {
+			app.Logger.WarnContext(ctx, "Readiness check failed", "check", name, "err", err)
+			ready = false
+		}
+	}
+
+	readiness.ready, readiness.checked = ready, time.Now()
+	return ready
+}
+
+// Readyz reports whether the app can serve requests: it is not shutting down,
+// and postgres, redis and the smtp relay can be reached. It tells the result of
+// every check, with the errors, so it is served on the admin address only.
+func (app *Config) Readyz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	resp := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks,omitempty"`
+	}{Status: "ready"}
+
+	if app.Draining.Load() {
+		status = http.StatusServiceUnavailable
+		resp.Status = "shutting down"
+	} else {
+		resp.Checks = make(map[string]string)
+		for name, err := range app.checkReadiness(r.Context()) {
+			resp.Checks[name] = "ok"
+			if err != nil {
+				app.Logger.WarnContext(r.Context(), "Readiness check failed", "check", name, "err", err)
+				resp.Checks[name] = err.Error()
+				status = http.StatusServiceUnavailable
+				resp.Status = "not ready"
+			}
+		}
+	}
+
+	writeReadiness(w, status, resp)
+}
+
+func writeReadiness(w http.ResponseWriter, status int, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkReadiness runs the checks at the same time, and returns the result of
+// each by name
+func (app *Config) checkReadiness(ctx context.Context) map[string]error {
+	checks := map[string]readinessCheck{
+		"postgres": app.checkDB,
+		"redis":    app.checkRedis,
+		"smtp":     app.checkSMTP,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error, len(checks))
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check readinessCheck) {
+			defer wg.Done()
+			err := runCheck(ctx, check)
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// runCheck gives up on the check after readinessTimeout, even when the client
+// it uses does not take a context
+func runCheck(ctx context.Context, check readinessCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out")
+	}
+}
+
+func (app *Config) checkDB(ctx context.Context) error {
+	return app.DB.PingContext(ctx)
+}
+
+func (app *Config) checkRedis(ctx context.Context) error {
+	conn, err := app.Redis.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("PING")
+	return err
+}
+
+// checkSMTP connects to the relay and waits for its greeting, without sending
+// a mail
+func (app *Config) checkSMTP(ctx context.Context) error {
+	addr := net.JoinHostPort(app.Mailer.Host, fmt.Sprint(app.Mailer.Port))
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, app.Mailer.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	//Quit would say hello first, the greeting is enough
+	id, err := client.Text.Cmd("QUIT")
+	if err != nil {
+		return err
+	}
+	client.Text.StartResponse(id)
+	defer client.Text.EndResponse(id)
+	_, _, err = client.Text.ReadResponse(221)
+	return err
+}
@@ -1,6 +1,26 @@
 package main
 
-func (app *Config) sendEmail(msg Message) {
+import (
+	"context"
+	"gosub/logging"
+	"net/http"
+)
+
+// sendEmail queues a message for the mailer. It is logged with the fields of ctx,
+// so a mail can be traced back to the request that sent it.
+func (app *Config) sendEmail(ctx context.Context, msg Message) {
+	msg.ctx = logging.Detach(context.WithoutCancel(ctx))
 	app.Wait.Add(1)
 	app.Mailer.Mailerchan <- msg
 }
+
+// refreshSessionUser reloads the user in the session from the database
+func (app *Config) refreshSessionUser(r *http.Request, id int) error {
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	app.Session.Put(r.Context(), "user", *user)
+	return nil
+}
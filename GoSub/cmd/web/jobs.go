@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/logging"
+	"gosub/reporting"
+	"html/template"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// job types
+const (
+	jobInvoiceMail = "invoice_mail"
+	jobManual      = "manual"
+	jobDataExport  = "data_export"
+)
+
+const (
+	//how long an idle worker waits before looking for work again
+	jobPollInterval = time.Second
+	//how often a worker tells its job is still running
+	jobHeartbeatInterval = time.Minute
+	//jobs without a heartbeat for this long were cut off by a restart or a crash
+	staleJobAge = 15 * time.Minute
+)
+
+// JobHandler does the work of one job. A returned error, or a panic, fails the
+// attempt and the job is retried later. Records logged with ctx carry the job.
+type JobHandler func(ctx context.Context, job *data.Job) error
+
+type jobType struct {
+	workers     int
+	maxAttempts int
+	handler     JobHandler
+}
+
+// JobOptions are the optional settings of an enqueued job. A job with a UniqueKey is
+// not enqueued again while another one of the same type and key is pending.
+type JobOptions struct {
+	RunAt     time.Time
+	UniqueKey string
+}
+
+// JobQueue runs jobs stored in the jobs table with a pool of workers per type
+type JobQueue struct {
+	Jobs      data.Job
+	ErrorChan chan error
+	Logger    *slog.Logger
+	types     map[string]jobType
+	done      chan struct{}
+	wait      sync.WaitGroup
+}
+
+// NewJobQueue returns a queue with no job types registered
+func NewJobQueue(jobs data.Job, errorChan chan error, logger *slog.Logger) *JobQueue {
+	return &JobQueue{
+		Jobs:      jobs,
+		ErrorChan: errorChan,
+		Logger:    logger,
+		types:     make(map[string]jobType),
+		done:      make(chan struct{}),
+	}
+}
+
+// Register adds a job type. The worker count can be overridden with the
+// JOB_WORKERS_<TYPE> environment variable.
+func (q *JobQueue) Register(name string, workers, maxAttempts int, handler JobHandler) {
+	if n, err := strconv.Atoi(os.Getenv("JOB_WORKERS_" + strings.ToUpper(name))); err == nil {
+		workers = n
+	}
+
+	q.types[name] = jobType{
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		handler:     handler,
+	}
+}
+
+// Enqueue stores a job to be run by the workers of its type. It returns
+// data.ErrDuplicateJob if a job with the same unique key is still pending.
+func (q *JobQueue) Enqueue(ctx context.Context, name string, payload any, opts JobOptions) (int64, error) {
+	t, ok := q.types[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown job type %q", name)
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return q.Jobs.Enqueue(ctx, data.Job{
+		Type:         name,
+		Payload:      b,
+		UniqueKey:    opts.UniqueKey,
+		MaxAttempts:  t.maxAttempts,
+		RunAt:        opts.RunAt,
+		TraceContext: injectTraceContext(ctx),
+	})
+}
+
+// Start requeues the jobs a previous run left behind and starts the workers
+func (q *JobQueue) Start() {
+	ctx := context.Background()
+	if err := q.RequeueStale(ctx); err != nil {
+		q.ErrorChan <- reporting.Wrap(ctx, err)
+	}
+
+	for name, t := range q.types {
+		for i := 0; i < t.workers; i++ {
+			q.wait.Add(1)
+			go q.work(name, t)
+		}
+	}
+}
+
+// RequeueStale puts back the running jobs without a heartbeat for staleJobAge. It
+// runs at startup, and as a task for the jobs of the instances that crashed and
+// are not restarted.
+func (q *JobQueue) RequeueStale(ctx context.Context) error {
+	n, err := q.Jobs.RequeueStale(ctx, time.Now().Add(-staleJobAge))
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		q.Logger.InfoContext(ctx, "Requeued interrupted jobs", "count", n)
+	}
+	return nil
+}
+
+// Stop lets every worker finish the job it is running, and waits for them
+func (q *JobQueue) Stop() {
+	close(q.done)
+	q.wait.Wait()
+}
+
+func (q *JobQueue) work(name string, t jobType) {
+	defer q.wait.Done()
+
+	ctx := logging.With(context.Background(), "job_type", name)
+
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		job, err := q.Jobs.Claim(ctx, name)
+		if err == nil {
+			q.run(job, t)
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			q.ErrorChan <- reporting.Wrap(ctx, err)
+		}
+
+		select {
+		case <-q.done:
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+func (q *JobQueue) run(job *data.Job, t jobType) {
+	ctx := logging.With(context.Background(), "job_id", job.ID, "job_type", job.Type, "attempt", job.Attempts)
+
+	//the job joins the trace of the request that enqueued it
+	ctx, span := tracer.Start(extractTraceContext(ctx, job.TraceContext), "job "+job.Type,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int64("job.id", job.ID),
+			attribute.Int("job.attempt", job.Attempts),
+		),
+	)
+
+	handlerCtx, stop := q.heartbeat(ctx, job)
+	err := runJobHandler(handlerCtx, t.handler, job)
+	stop()
+	endSpan(span, err)
+	if err == nil {
+		if err = job.Complete(ctx); err != nil {
+			q.ErrorChan <- reporting.Wrap(ctx, err)
+		}
+		return
+	}
+
+	q.ErrorChan <- reporting.Wrap(ctx, fmt.Errorf("job %d (%s) attempt %d/%d failed: %w", job.ID, job.Type, job.Attempts, job.MaxAttempts, err))
+
+	if err = job.Fail(ctx, err, time.Now().Add(retryDelay(job.Attempts))); err != nil {
+		q.ErrorChan <- reporting.Wrap(ctx, err)
+	}
+}
+
+// heartbeat touches the job every jobHeartbeatInterval until stop is called, so a
+// job running for longer than staleJobAge is not requeued under its worker. The
+// returned context, for the handler, is cancelled if the job was requeued anyway.
+func (q *JobQueue) heartbeat(ctx context.Context, job *data.Job) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+
+		ticker := time.NewTicker(jobHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := job.Heartbeat(ctx)
+				if err == nil {
+					continue
+				}
+				q.ErrorChan <- reporting.Wrap(ctx, err)
+				if errors.Is(err, data.ErrJobLost) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		wait.Wait()
+		cancel()
+	}
+}
+
+// runJobHandler turns a panic of the handler into an error with the stack of the
+// panic, so it fails the attempt instead of the whole process
+func runJobHandler(ctx context.Context, handler JobHandler, job *data.Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = reporting.Recovered(p)
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// retryDelay grows with every attempt: 30s, 2m, 4m30s, 8m, ...
+func retryDelay(attempts int) time.Duration {
+	return time.Duration(attempts*attempts) * 30 * time.Second
+}
+
+// registerJobs adds every job type the app knows to the queue
+func (app *Config) registerJobs() {
+	app.Jobs.Register(jobInvoiceMail, 2, 5, app.runInvoiceMailJob)
+	app.Jobs.Register(jobManual, 2, 3, app.runManualJob)
+	app.Jobs.Register(jobDataExport, 1, 3, app.runDataExportJob)
+}
+
+// invoiceMailPayload is the payload of an invoice_mail job
+type invoiceMailPayload struct {
+	InvoiceID int `json:"invoice_id"`
+}
+
+// runInvoiceMailJob mails an invoice that has been recorded already
+func (app *Config) runInvoiceMailJob(ctx context.Context, job *data.Job) error {
+	var payload invoiceMailPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(ctx, payload.InvoiceID)
+	if err != nil {
+		return err
+	}
+
+	key, err := app.invoiceFor(ctx, invoice)
+	if err != nil {
+		return err
+	}
+
+	pdf, err := app.readBlob(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       invoice.BillingEmail,
+		Subject:  "Your Invoice",
+		Data:     invoice.AmountForDisplay(),
+		Template: "invoice",
+		Attachments: map[string][]byte{
+			fmt.Sprintf("invoice-%d.pdf", invoice.ID): pdf,
+		},
+	}
+
+	return app.Mailer.deliver(ctx, msg)
+}
+
+// manualPayload is the payload of a manual job
+type manualPayload struct {
+	UserID int `json:"user_id"`
+	PlanID int `json:"plan_id"`
+}
+
+// runManualJob generates the manual of the plan for the user and mails it
+func (app *Config) runManualJob(ctx context.Context, job *data.Job) error {
+	var payload manualPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+
+	user, err := app.Models.User.GetOne(ctx, payload.UserID)
+	if err != nil {
+		return err
+	}
+
+	plan, err := app.Models.Plan.GetOne(ctx, payload.PlanID)
+	if err != nil {
+		return err
+	}
+
+	key, err := app.manualFor(ctx, *user, plan)
+	if err != nil {
+		return err
+	}
+
+	pdf, err := app.readBlob(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your Manual",
+		Data:    "Your manual is attached. You can download it again any time from the documents page of your account.",
+		Attachments: map[string][]byte{
+			"manual.pdf": pdf,
+		},
+	}
+
+	return app.Mailer.deliver(ctx, msg)
+}
+
+// dataExportPayload is the payload of a data_export job
+type dataExportPayload struct {
+	UserID int `json:"user_id"`
+}
+
+// runDataExportJob builds the data export of the user and mails the download link
+func (app *Config) runDataExportJob(ctx context.Context, job *data.Job) error {
+	var payload dataExportPayload
+	if err := job.Decode(&payload); err != nil {
+		return err
+	}
+
+	user, err := app.Models.User.GetOne(ctx, payload.UserID)
+	if err != nil {
+		return err
+	}
+
+	name, err := app.buildDataExport(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  "Your data is ready to download",
+		Template: "data-export",
+		Data:     template.HTML(dataExportURL(name)),
+	}
+
+	return app.Mailer.deliver(ctx, msg)
+}
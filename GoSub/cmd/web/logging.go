@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"gosub/logging"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// logError reports err and logs it with the fields of ctx, unless it repeats too
+// often. The source of the record is the caller, not this function.
+func (app *Config) logError(ctx context.Context, err error, args ...any) {
+	if !app.Errors.Capture(ctx, err, 1) || !app.Logger.Enabled(ctx, slog.LevelError) {
+		return
+	}
+
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:])
+
+	r := slog.NewRecord(time.Now(), slog.LevelError, err.Error(), pcs[0])
+	r.Add(args...)
+	_ = app.Logger.Handler().Handle(ctx, r)
+}
+
+// RequestLogger attaches the request id, the route and the user to every record
+// logged with the context of the request, and logs the request once it is served.
+// It runs after SessionLoad, so the user can be read from the session.
+func (app *Config) RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		//the route and the user are read when a record is logged: the route is
+		//only known once chi has matched it, and the user may log in meanwhile.
+		//Work that outlives the request takes a logging.Detach copy of ctx.
+		ctx := r.Context()
+		ctx = logging.With(ctx,
+			"request_id", middleware.GetReqID(ctx),
+			"route", logging.Lazy(func() slog.Value {
+				if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+					return slog.StringValue(rctx.RoutePattern())
+				}
+				return slog.GroupValue()
+			}),
+			"user_id", logging.Lazy(func() slog.Value {
+				if id := app.Session.GetInt(ctx, "userID"); id != 0 {
+					return slog.IntValue(id)
+				}
+				return slog.GroupValue()
+			}),
+		)
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if ww.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		app.Logger.LogAttrs(ctx, level, "Request served",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", ww.Status()),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
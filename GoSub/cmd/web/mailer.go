@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"html/template"
+	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
 	mail "github.com/xhit/go-simple-mail/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Mail struct {
@@ -21,8 +25,8 @@ type Mail struct {
 	FromAddress string
 	FromName    string
 	Wait        *sync.WaitGroup
+	Logger      *slog.Logger
 	Mailerchan  chan Message
-	Errorchan   chan error
 	DoneChan    chan bool
 }
 
@@ -35,6 +39,8 @@ type Message struct {
 	Data           any //we will reassign it to DataMap after receiving a msg.Data property
 	DataMap        map[string]interface{}
 	Template       string
+	Attachments    map[string][]byte //in memory attachments, by file name
+	ctx            context.Context   //of the request or job that sent it, for the logs and traces
 }
 
 // a function to listen for messages in the Mailer channel
@@ -42,18 +48,42 @@ func (app *Config) listenForMail() {
 	for {
 		select {
 		case msg := <-app.Mailer.Mailerchan:
-			go app.Mailer.sendMail(msg, app.Mailer.Errorchan)
-		case err := <-app.Mailer.Errorchan:
-			app.ErrorLog.Println(err)
+			go app.Mailer.sendMail(msg)
 		case <-app.Mailer.DoneChan:
 			return
 		}
 	}
 }
 
-func (m *Mail) sendMail(msg Message, errorChan chan error) {
+func (m *Mail) sendMail(msg Message) {
 	defer m.Wait.Done()
 
+	if err := m.deliver(msg.ctx, msg); err != nil {
+		m.Logger.ErrorContext(msg.ctx, "Sending mail failed", "err", err, "subject", msg.Subject, "template", msg.Template)
+	}
+}
+
+// deliver builds the message and sends it right away. Jobs call it directly, so a
+// failed send is returned to the job queue and retried instead of only logged.
+func (m *Mail) deliver(ctx context.Context, msg Message) error {
+	ctx, span := tracer.Start(ctx, "mail.deliver",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("mail.template", msg.Template)),
+	)
+
+	err := m.send(msg)
+	endSpan(span, err)
+	if err != nil {
+		mailsFailed.Inc()
+		return err
+	}
+
+	mailsSent.Inc()
+	m.Logger.InfoContext(ctx, "Mail sent", "subject", msg.Subject, "template", msg.Template)
+	return nil
+}
+
+func (m *Mail) send(msg Message) error {
 	if msg.Template == "" {
 		//send email without template
 		msg.Template = "mail"
@@ -80,15 +110,13 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 	//build html mail
 	formattedMesage, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		errorChan <- err
-		return
+		return err
 	}
 
 	//build text mail
 	plainMesage, err := m.buildTextMessage(msg)
 	if err != nil {
-		errorChan <- err
-		return
+		return err
 	}
 
 	//configure smtp server connection settings from Mail server type
@@ -105,8 +133,7 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 	//get your smtp client by connecting to the server
 	smtpClient, err := server.Connect()
 	if err != nil {
-		errorChan <- err
-		return
+		return err
 	}
 	defer smtpClient.Close()
 
@@ -124,12 +151,16 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 		}
 	}
 
+	for name, b := range msg.Attachments {
+		email.Attach(&mail.File{Name: name, Data: b})
+	}
+
 	//send your mail via smtp client
-	err = email.Send(smtpClient)
-	if err != nil {
-		errorChan <- err
-		return
+	if err = email.Send(smtpClient); err != nil {
+		return err
 	}
+
+	return nil
 }
 
 func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"gosub/data"
-	"log"
+	"gosub/logging"
+	"gosub/reporting"
+	"gosub/storage"
+	"gosub/validation"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -18,25 +26,52 @@ import (
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
 const webPort = "8000"
 
 func main() {
+	//create the logger first, everything after logs through it
+	logger := initLogger()
+	slog.SetDefault(logger)
+	data.SetLogger(logger)
+
+	//export traces to the collector
+	tracerProvider := initTracer()
+
 	//connect to database
 	db := initDB()
 
+	//connect to redis
+	redisPool := initRedis()
+
 	//create sessions
-	session := initSession()
+	session := initSession(redisPool)
+
+	//setup password policy
+	passwordPolicy := initPasswordPolicy()
+	data.SetPasswordPolicy(passwordPolicy)
+	data.SetPasswordHasher(initPasswordHasher())
 
-	//create loggers
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	//encrypt the secrets kept in the database
+	initSecretKey()
+
+	//sign the links mailed to users
+	NewURLSigner(requiredKey("URL_SIGNING_KEY"))
 
 	//create channels
 	errorChan := make(chan error)
 	errorChanDone := make(chan bool)
 
+	//report errors, to the logs, the sinks and the digest mailed to the admins
+	errorReporter := initErrorReporter()
+
 	//create waitGroups
 	wg := &sync.WaitGroup{}
 
@@ -44,13 +79,34 @@ func main() {
 	app := Config{
 		Session:       session,
 		DB:            db,
+		Redis:         redisPool,
 		Wait:          wg,
-		InfoLog:       infoLog,
-		ErrorLog:      errorLog,
+		Logger:        logger,
 		Models:        data.New(db),
+		Passwords:     passwordPolicy,
 		ErrorChan:     errorChan,
 		ErrorChanDone: errorChanDone,
+		Activation:    initActivationPolicy(),
+		Blobs:         initBlobStore(),
+		Tracer:        tracerProvider,
+		Errors:        errorReporter,
+	}
+
+	//a session that can not be loaded, and a bad blob link, get the error pages
+	//of the site instead of a plain text error
+	app.Session.ErrorFunc = app.serverError
+	if store, ok := app.Blobs.(*storage.LocalStore); ok {
+		store.ErrorPage = app.errorPageWith
+	}
+
+	//load the manual layouts, their templates are imported once and every
+	//manual is stamped on a copy
+	manuals, err := initManualLayouts()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
 	}
+	app.Manuals = manuals
 
 	//setup mail
 	app.Mailer = app.createMail()
@@ -62,15 +118,35 @@ func main() {
 	//listen for errors
 	go app.listenForErros()
 
+	//run background jobs
+	app.Jobs = NewJobQueue(app.Models.Job, app.ErrorChan, app.Logger)
+	app.registerJobs()
+	app.Jobs.Start()
+
+	//run recurring maintenance tasks
+	app.Scheduler = NewScheduler(app.ErrorChan, app.Logger)
+	app.registerTasks()
+	app.Scheduler.Start()
+
+	//serve the metrics on the admin address
+	app.spinAdminServer()
+
 	//listen for web connections
 	app.spinServer()
 }
 
+// listenForErros reports the errors sent on the error channel. They are sent
+// wrapped with reporting.Wrap, so they carry the stack and the context of the
+// sender rather than the ones of this loop.
 func (app *Config) listenForErros() {
 	for {
 		select {
 		case err := <-app.ErrorChan:
-			app.ErrorLog.Println(err)
+			errorsReported.Inc()
+			ctx := reporting.ContextOf(err)
+			if app.Errors.Capture(ctx, err, 0) {
+				app.Logger.ErrorContext(ctx, err.Error())
+			}
 		case <-app.ErrorChanDone:
 			return
 		}
@@ -79,15 +155,19 @@ func (app *Config) listenForErros() {
 
 func (app *Config) spinServer() {
 	//start server
-	srv := &http.Server{
+	app.Server = &http.Server{
 		Addr:    ":" + webPort,
 		Handler: app.routes(),
 	}
-	app.InfoLog.Printf("Starting server on port %s", webPort)
-	err := srv.ListenAndServe()
-	if err != nil {
-		app.ErrorLog.Fatal(err)
+	app.Logger.Info("Starting server", "port", webPort)
+	err := app.Server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		app.Logger.Error(err.Error())
+		os.Exit(1)
 	}
+
+	//the server is closed on shutdown, which exits once the clean up is done
+	select {}
 }
 
 // For postgress DB!!
@@ -107,9 +187,9 @@ func connectToDB() *sql.DB {
 	for {
 		connection, err := openDB(dsn)
 		if err != nil {
-			println("Trying to reconnect to database!")
+			slog.Warn("Trying to reconnect to database", "err", err)
 		} else {
-			println("Connected to database!")
+			slog.Info("Connected to database")
 			return connection
 		}
 
@@ -117,7 +197,7 @@ func connectToDB() *sql.DB {
 			return nil
 		}
 
-		println("Waiting for 1 second before trying again!")
+		slog.Info("Waiting for 1 second before trying again")
 		time.Sleep(time.Second * 1)
 		counts++
 	}
@@ -136,14 +216,232 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// For logging, LOG_FORMAT is json or text and LOG_LEVEL is debug, info, warn or error
+func initLogger() *slog.Logger {
+	level := slog.LevelInfo
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		var err error
+		level, err = logging.ParseLevel(s)
+		if err != nil {
+			panic("unknown log level: " + s)
+		}
+	}
+
+	logger, err := logging.New(os.Stdout, os.Getenv("LOG_FORMAT"), level)
+	if err != nil {
+		panic(err)
+	}
+	return logger
+}
+
+// For tracing, spans are exported over OTLP/HTTP to the collector at
+// OTEL_EXPORTER_OTLP_ENDPOINT, http://localhost:4318 by default. TRACING=false
+// turns the export off, the trace context of callers is still passed on.
+func initTracer() *sdktrace.TracerProvider {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !envBool("TRACING", true) {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		panic("failed to create the trace exporter: " + err.Error())
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("gosub")))
+	if err != nil {
+		panic(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	//a collector that is down must not fill the logs with every failed export
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Tracing failed", "err", err)
+	}))
+
+	return provider
+}
+
+// For error reports, ERROR_WEBHOOK_URL adds a sink that takes them as JSON, and
+// ERROR_RATE_BURST is how many errors of a kind are reported per minute
+func initErrorReporter() *reporting.Reporter {
+	opts := reporting.Options{
+		OnSinkError: func(err error) {
+			slog.Warn("Sending error report failed", "err", err)
+		},
+	}
+
+	if url := os.Getenv("ERROR_WEBHOOK_URL"); url != "" {
+		opts.Sinks = append(opts.Sinks, reporting.NewWebhookSink(url))
+	}
+	if n, err := strconv.Atoi(os.Getenv("ERROR_RATE_BURST")); err == nil {
+		opts.Burst = n
+	}
+
+	return reporting.New(opts)
+}
+
+// For password policy
+func initPasswordPolicy() *validation.PasswordPolicy {
+	policy := validation.DefaultPasswordPolicy()
+
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil {
+		policy.MinLength = n
+	}
+	policy.RequireUpper = envBool("PASSWORD_REQUIRE_UPPER", policy.RequireUpper)
+	policy.RequireLower = envBool("PASSWORD_REQUIRE_LOWER", policy.RequireLower)
+	policy.RequireDigit = envBool("PASSWORD_REQUIRE_DIGIT", policy.RequireDigit)
+	policy.RequireSymbol = envBool("PASSWORD_REQUIRE_SYMBOL", policy.RequireSymbol)
+	policy.DisallowEmail = envBool("PASSWORD_DISALLOW_EMAIL", policy.DisallowEmail)
+
+	//offline list of sha1 hashes of breached passwords, sorted by hash
+	if path := os.Getenv("BREACHED_PASSWORDS"); path != "" {
+		list, err := validation.LoadBreachedList(path)
+		if err != nil {
+			panic("failed to load breached passwords: " + err.Error())
+		}
+		slog.Info("Opened breached password hashes", "path", path, "bytes", list.Size())
+		policy.Breached = list
+	}
+
+	return policy
+}
+
+// For password hashing, existing hashes are upgraded to this on the next login
+func initPasswordHasher() data.PasswordHasher {
+	hasher := data.DefaultPasswordHasher()
+
+	switch algorithm := os.Getenv("PASSWORD_HASH"); algorithm {
+	case "":
+	case data.HashBcrypt, data.HashArgon2id:
+		hasher.Algorithm = algorithm
+	default:
+		panic("unknown password hash algorithm: " + algorithm)
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil {
+		hasher.BcryptCost = n
+	}
+	if n, err := strconv.ParseUint(os.Getenv("ARGON2_TIME"), 10, 32); err == nil {
+		hasher.Argon2.Time = uint32(n)
+	}
+	if n, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY"), 10, 32); err == nil {
+		hasher.Argon2.Memory = uint32(n)
+	}
+	if n, err := strconv.ParseUint(os.Getenv("ARGON2_THREADS"), 10, 8); err == nil {
+		hasher.Argon2.Threads = uint8(n)
+	}
+
+	return hasher
+}
+
+// minKeyLength is the shortest secret key the app starts with
+const minKeyLength = 32
+
+// requiredKey reads a secret key from the environment. There is no default: a
+// key committed with the code would protect nothing.
+func requiredKey(name string) []byte {
+	key := os.Getenv(name)
+	if len(key) < minKeyLength {
+		panic(fmt.Sprintf("%s must be set, to at least %d characters", name, minKeyLength))
+	}
+
+	return []byte(key)
+}
+
+// For the secrets kept in the database, like the TOTP secrets
+func initSecretKey() {
+	if err := data.SetSecretKey(requiredKey("SECRET_ENCRYPTION_KEY")); err != nil {
+		panic("failed to set the secret key: " + err.Error())
+	}
+}
+
+// For activation reminders and the expiry of accounts that were never activated
+func initActivationPolicy() ActivationPolicy {
+	policy := DefaultActivationPolicy()
+
+	if n, err := strconv.Atoi(os.Getenv("ACTIVATION_REMINDER_HOURS")); err == nil {
+		policy.RemindAfter = time.Duration(n) * time.Hour
+	}
+	if n, err := strconv.Atoi(os.Getenv("ACTIVATION_EXPIRY_DAYS")); err == nil {
+		policy.ExpireAfter = time.Duration(n) * 24 * time.Hour
+	}
+
+	return policy
+}
+
+// For the manuals, the layout file can be swapped with MANUAL_LAYOUTS
+func initManualLayouts() (*ManualLayouts, error) {
+	path := os.Getenv("MANUAL_LAYOUTS")
+	if path == "" {
+		path = defaultManualLayoutsPath
+	}
+
+	//licence keys are an HMAC, anyone with the key can make them
+	return loadManualLayouts(path, requiredKey("LICENCE_KEY_SECRET"))
+}
+
+// For generated files, kept on the local disk or in an S3 compatible store
+func initBlobStore() storage.BlobStore {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "./blobs"
+		}
+		//the download links of the local store are signed with it
+		key := requiredKey("BLOB_SIGNING_KEY")
+
+		store, err := storage.NewLocalStore(dir, "http://localhost:8000"+localBlobsPath, key)
+		if err != nil {
+			panic("failed to open the blob store: " + err.Error())
+		}
+		return store
+	case "s3":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		store, err := storage.NewS3Store(ctx, storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			UseSSL:    envBool("S3_USE_SSL", false),
+		})
+		if err != nil {
+			panic("failed to connect to the blob store: " + err.Error())
+		}
+		slog.Info("Connected to blob store")
+		return store
+	default:
+		panic("unknown blob store: " + kind)
+	}
+}
+
+// envBool reads a true/false environment variable, falling back to def when unset
+func envBool(key string, def bool) bool {
+	b, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
 // For redis session
-func initSession() *scs.SessionManager {
+func initSession(redisPool *redis.Pool) *scs.SessionManager {
 	//tell about the type of session we want to use
 	gob.Register(data.User{})
 	//setup session
 	session := scs.New()
-	session.Store = redisstore.New(initRedis())
-	session.Lifetime = 24 * time.Hour
+	session.Store = tracedStore{redisstore.New(redisPool)}
+	session.Lifetime = sessionLifetime
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
 	session.Cookie.Secure = true
@@ -170,7 +468,33 @@ func (app *Config) listenForShutDown() {
 }
 
 func (app *Config) shutdown() {
-	app.InfoLog.Println("Running Clean Up Tasks!!...")
+	//fail readiness first, so the load balancer stops sending requests before
+	//the server stops taking them
+	app.Draining.Store(true)
+	app.Logger.Info("Draining", "delay", drainDelay)
+	time.Sleep(drainDelay)
+
+	//let the requests in flight finish
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if app.Server != nil {
+		if err := app.Server.Shutdown(ctx); err != nil {
+			app.Logger.Error(err.Error())
+		}
+	}
+	if app.AdminServer != nil {
+		if err := app.AdminServer.Shutdown(ctx); err != nil {
+			app.Logger.Error(err.Error())
+		}
+	}
+
+	app.Logger.Info("Running clean up tasks")
+
+	//stop the scheduled tasks, after the running ones are done
+	app.Scheduler.Stop()
+
+	//let the workers finish their jobs, the rest stay queued for the next start
+	app.Jobs.Stop()
 
 	//wait for all goroutines to finish (waitGroup)
 	app.Wait.Wait()
@@ -179,12 +503,21 @@ func (app *Config) shutdown() {
 	app.Mailer.DoneChan <- true
 	app.ErrorChanDone <- true
 
+	//send the error reports that are still queued
+	app.Errors.Close()
+
+	//send the spans that are still buffered
+	if app.Tracer != nil {
+		if err := app.Tracer.Shutdown(ctx); err != nil {
+			app.Logger.Error(err.Error())
+		}
+	}
+
 	//close error log
-	app.InfoLog.Println("Server gracefully shutdown! && closing channels!!...")
+	app.Logger.Info("Server gracefully shut down, closing channels")
 
 	//close channels
 	close(app.Mailer.Mailerchan)
-	close(app.Mailer.Errorchan)
 	close(app.Mailer.DoneChan)
 	close(app.ErrorChan)
 	close(app.ErrorChanDone)
@@ -199,7 +532,7 @@ func (app *Config) createMail() Mail {
 		Encryption:  "none",
 		FromAddress: "info@mycompany.com",
 		FromName:    "Company",
-		Errorchan:   make(chan error),
+		Logger:      app.Logger,
 		Mailerchan:  make(chan Message, 100),
 		Wait:        app.Wait,
 		DoneChan:    make(chan bool),
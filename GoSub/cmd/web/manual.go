@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/storage"
+	"io"
+	"os"
+	"time"
+
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+)
+
+const (
+	//manuals are kept in the blob store under this prefix
+	manualsPrefix = "manuals/"
+	//cached manuals older than this are garbage-collected, and made again when asked for
+	manualCacheMaxAge = 7 * 24 * time.Hour
+	//bump when generateManual changes, so cached manuals are made again; a
+	//change of the layout file does that by itself
+	manualLayoutVersion = 1
+)
+
+// pdfTemplate holds the pages of a PDF imported with gofpdi, kept in memory so
+// the file is parsed once instead of for every document it is used in
+type pdfTemplate struct {
+	version   string
+	objects   map[string][]byte
+	positions map[string]map[int]string
+	templates map[string]string
+	pages     []importedPage
+}
+
+// importedPage is where gofpdi placed one page of a template
+type importedPage struct {
+	name   string
+	scaleX float64
+	scaleY float64
+	tX     float64
+	tY     float64
+}
+
+// loadPDFTemplate imports every page of the PDF at path, scaled to the width w
+func loadPDFTemplate(path string, box string, w float64) (tpl *pdfTemplate, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	//gofpdi panics on a broken file
+	defer func() {
+		if p := recover(); p != nil {
+			tpl, err = nil, fmt.Errorf("importing %s: %v", path, p)
+		}
+	}()
+
+	sum := sha256.Sum256(b)
+	tpl = &pdfTemplate{
+		version:   hex.EncodeToString(sum[:8]),
+		objects:   make(map[string][]byte),
+		positions: make(map[string]map[int]string),
+		templates: make(map[string]string),
+	}
+
+	rs := io.ReadSeeker(bytes.NewReader(b))
+	importer := gofpdi.NewImporter()
+
+	//the page count is known once the first page is in
+	for page, count := 1, 1; page <= count; page++ {
+		id := importer.ImportPageFromStream(tpl, &rs, page, box)
+		importer.UseImportedTemplate(tpl, id, 0, 0, w, 0)
+		count = len(importer.GetPageSizes())
+	}
+
+	return tpl, nil
+}
+
+// importInto adds the objects of the template to pdf, so its pages can be used
+func (t *pdfTemplate) importInto(pdf *gofpdf.Fpdf) {
+	//gofpdf writes the object ids into the bytes it was given, so every
+	//document gets its own copy
+	objects := make(map[string][]byte, len(t.objects))
+	for k, v := range t.objects {
+		objects[k] = bytes.Clone(v)
+	}
+
+	pdf.ImportObjects(objects)
+	pdf.ImportObjPos(t.positions)
+	pdf.ImportTemplates(t.templates)
+}
+
+// usePage draws page n of the template, counting from 1, on the current page of
+// pdf. The template must have been imported into pdf already.
+func (t *pdfTemplate) usePage(pdf *gofpdf.Fpdf, n int) {
+	page := t.pages[n-1]
+	pdf.UseImportedTemplate(page.name, page.scaleX, page.scaleY, page.tX, page.tY)
+}
+
+// the methods below let gofpdi import into the template instead of into a document
+
+func (t *pdfTemplate) ImportObjects(objs map[string][]byte) {
+	for k, v := range objs {
+		t.objects[k] = v
+	}
+}
+
+func (t *pdfTemplate) ImportObjPos(objs map[string]map[int]string) {
+	for k, v := range objs {
+		t.positions[k] = v
+	}
+}
+
+func (t *pdfTemplate) ImportTemplates(tpls map[string]string) {
+	for k, v := range tpls {
+		t.templates[k] = v
+	}
+}
+
+func (t *pdfTemplate) UseImportedTemplate(tplName string, scaleX, scaleY, tX, tY float64) {
+	t.pages = append(t.pages, importedPage{tplName, scaleX, scaleY, tX, tY})
+}
+
+func (t *pdfTemplate) SetError(err error) {
+	panic(err)
+}
+
+// manualFor returns the key of the personalised manual of the user for the plan
+// in the blob store. A manual made earlier from the same layout and values is
+// reused.
+func (app *Config) manualFor(ctx context.Context, user data.User, plan *data.Plan) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, blobTimeout)
+	defer cancel()
+
+	layout := app.Manuals.forPlan(plan.PlanName)
+	values := manualValues{
+		Name:       fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+		Email:      user.Email,
+		Plan:       plan.PlanName,
+		IssueDate:  app.manualIssueDate(ctx, user.ID, plan.ID).Format("January 2, 2006"),
+		LicenceKey: app.Manuals.licenceKey(user.ID, plan.ID),
+	}
+
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", manualLayoutVersion, layout.version, b)))
+	prefix := fmt.Sprintf("%s%d_%d_", manualsPrefix, user.ID, plan.ID)
+	key := prefix + hex.EncodeToString(sum[:8]) + ".pdf"
+
+	_, err = app.Blobs.Stat(ctx, key)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return "", err
+	}
+
+	buf, err := app.renderManual(ctx, layout, values)
+	if err != nil {
+		return "", err
+	}
+
+	if err = app.Blobs.Put(ctx, key, buf, int64(buf.Len()), "application/pdf"); err != nil {
+		return "", err
+	}
+
+	//the manuals made before a change of name or template are not needed anymore
+	old, err := app.Blobs.List(ctx, prefix)
+	if err != nil {
+		app.logError(ctx, err)
+	}
+	for _, blob := range old {
+		if blob.Key != key {
+			if err = app.Blobs.Delete(ctx, blob.Key); err != nil {
+				app.logError(ctx, err)
+			}
+		}
+	}
+
+	return key, nil
+}
+
+// renderManual generates the manual and writes out the PDF, in a span of its own
+func (app *Config) renderManual(ctx context.Context, layout *manualLayout, values manualValues) (buf *bytes.Buffer, err error) {
+	_, span := tracer.Start(ctx, "pdf.manual")
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	pdf, err := app.generateManual(layout, values)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = &bytes.Buffer{}
+	if err = pdf.Output(buf); err != nil {
+		return nil, err
+	}
+	pdfDuration.WithLabelValues("manual").Observe(time.Since(start).Seconds())
+
+	return buf, nil
+}
+
+// manualIssueDate is when the user last subscribed to the plan, which stays the
+// same however often the manual is made again
+func (app *Config) manualIssueDate(ctx context.Context, userID, planID int) time.Time {
+	history, err := app.Models.SubscriptionRecord.GetHistory(ctx, userID)
+	if err != nil {
+		app.logError(ctx, err)
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].PlanID == planID {
+			return history[i].StartedAt
+		}
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/phpdave11/gofpdf"
+)
+
+const defaultManualLayoutsPath = "./pdf/manuals.json"
+
+// manualLayoutFile is the layout file of the manuals. A plan without a layout of
+// its own gets the default one, and a plan layout takes whatever it leaves out
+// from the default.
+type manualLayoutFile struct {
+	Default ManualLayout            `json:"default"`
+	Plans   map[string]ManualLayout `json:"plans"` //by plan name, in any case
+}
+
+// ManualLayout says how the manual of a plan is made. Every text is a Go
+// template over manualValues, like "{{.Name}}" or "Licence: {{.LicenceKey}}".
+type ManualLayout struct {
+	Template  string           `json:"template"` //PDF, relative to the layout file; every page is used
+	Title     string           `json:"title"`
+	Author    string           `json:"author"`
+	Subject   string           `json:"subject"`
+	Keywords  string           `json:"keywords"`
+	Fields    []ManualField    `json:"fields"`
+	Watermark *ManualWatermark `json:"watermark"`
+}
+
+// ManualField is a text written at a fixed place of the manual
+type ManualField struct {
+	Page  int     `json:"page"` //counting from 1, 0 is every page
+	Text  string  `json:"text"`
+	X     float64 `json:"x"`     //mm from the left edge
+	Y     float64 `json:"y"`     //mm from the top edge
+	Width float64 `json:"width"` //mm, 0 runs to the right margin
+	Font  string  `json:"font"`  //Arial, Helvetica, Times or Courier
+	Style string  `json:"style"` //any of B, I and U
+	Size  float64 `json:"size"`  //points
+	Align string  `json:"align"` //L, C or R
+	Color [3]int  `json:"color"` //RGB
+}
+
+// ManualWatermark is a text drawn across the middle of the pages
+type ManualWatermark struct {
+	Text    string  `json:"text"`
+	Pages   []int   `json:"pages"` //counting from 1, none is every page
+	Font    string  `json:"font"`
+	Style   string  `json:"style"`
+	Size    float64 `json:"size"`
+	Color   [3]int  `json:"color"`
+	Angle   float64 `json:"angle"`   //degrees, counterclockwise
+	Opacity float64 `json:"opacity"` //0 to 1, left out is opaque
+}
+
+// manualValues are what the texts of a layout can use
+type manualValues struct {
+	Name       string
+	FirstName  string
+	LastName   string
+	Email      string
+	Plan       string
+	IssueDate  string
+	LicenceKey string
+}
+
+// ManualLayouts are the loaded layouts of the manuals, with their templates
+// imported
+type ManualLayouts struct {
+	def    *manualLayout
+	plans  map[string]*manualLayout
+	secret []byte
+}
+
+// manualLayout is a checked layout, ready to make manuals with
+type manualLayout struct {
+	ManualLayout
+	version  string
+	template *pdfTemplate
+	texts    *template.Template
+}
+
+// loadManualLayouts reads the layout file at path and imports the templates it
+// uses. Licence keys are signed with secret.
+func loadManualLayouts(path string, secret []byte) (*ManualLayouts, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file manualLayoutFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	layouts := &ManualLayouts{
+		plans:  make(map[string]*manualLayout),
+		secret: secret,
+	}
+	//plans often share a template, import each one once
+	templates := make(map[string]*pdfTemplate)
+
+	layouts.def, err = compileManualLayout(file.Default, filepath.Dir(path), templates)
+	if err != nil {
+		return nil, fmt.Errorf("%s: default layout: %w", path, err)
+	}
+
+	for name, layout := range file.Plans {
+		compiled, err := compileManualLayout(mergeManualLayout(file.Default, layout), filepath.Dir(path), templates)
+		if err != nil {
+			return nil, fmt.Errorf("%s: layout of %s: %w", path, name, err)
+		}
+		layouts.plans[strings.ToLower(name)] = compiled
+	}
+
+	return layouts, nil
+}
+
+// mergeManualLayout fills in what the plan layout leaves out from the default
+func mergeManualLayout(def, plan ManualLayout) ManualLayout {
+	if plan.Template == "" {
+		plan.Template = def.Template
+	}
+	if plan.Title == "" {
+		plan.Title = def.Title
+	}
+	if plan.Author == "" {
+		plan.Author = def.Author
+	}
+	if plan.Subject == "" {
+		plan.Subject = def.Subject
+	}
+	if plan.Keywords == "" {
+		plan.Keywords = def.Keywords
+	}
+	if plan.Fields == nil {
+		plan.Fields = def.Fields
+	}
+	if plan.Watermark == nil {
+		plan.Watermark = def.Watermark
+	}
+	return plan
+}
+
+// compileManualLayout checks a layout, fills in the defaults of its fields and
+// parses its texts
+func compileManualLayout(layout ManualLayout, dir string, templates map[string]*pdfTemplate) (*manualLayout, error) {
+	if layout.Template == "" {
+		return nil, fmt.Errorf("no template")
+	}
+
+	path := layout.Template
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	tpl, ok := templates[path]
+	if !ok {
+		var err error
+		tpl, err = loadPDFTemplate(path, "/MediaBox", 215.9)
+		if err != nil {
+			return nil, err
+		}
+		templates[path] = tpl
+	}
+
+	texts := template.New("manual")
+	parse := func(name, text string) error {
+		if text == "" {
+			return nil
+		}
+		t, err := texts.New(name).Parse(text)
+		if err != nil {
+			return err
+		}
+		//a misspelt value fails here rather than on the first manual
+		return t.Execute(io.Discard, manualValues{})
+	}
+
+	for name, text := range map[string]string{
+		"title":    layout.Title,
+		"author":   layout.Author,
+		"subject":  layout.Subject,
+		"keywords": layout.Keywords,
+	} {
+		if err := parse(name, text); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := make([]ManualField, len(layout.Fields))
+	for i, field := range layout.Fields {
+		if field.Page < 0 || field.Page > len(tpl.pages) {
+			return nil, fmt.Errorf("field %d: page %d is not in the template", i+1, field.Page)
+		}
+		if err := checkManualFont(&field.Font, &field.Style, &field.Size); err != nil {
+			return nil, fmt.Errorf("field %d: %w", i+1, err)
+		}
+		switch field.Align = strings.ToUpper(field.Align); field.Align {
+		case "":
+			field.Align = "L"
+		case "L", "C", "R":
+		default:
+			return nil, fmt.Errorf("field %d: unknown alignment %s", i+1, field.Align)
+		}
+		if err := parse(fmt.Sprintf("field%d", i), field.Text); err != nil {
+			return nil, err
+		}
+		fields[i] = field
+	}
+	layout.Fields = fields
+
+	if layout.Watermark != nil {
+		watermark := *layout.Watermark
+		for _, page := range watermark.Pages {
+			if page < 1 || page > len(tpl.pages) {
+				return nil, fmt.Errorf("watermark: page %d is not in the template", page)
+			}
+		}
+		if err := checkManualFont(&watermark.Font, &watermark.Style, &watermark.Size); err != nil {
+			return nil, fmt.Errorf("watermark: %w", err)
+		}
+		if watermark.Opacity <= 0 || watermark.Opacity > 1 {
+			watermark.Opacity = 1
+		}
+		if err := parse("watermark", watermark.Text); err != nil {
+			return nil, err
+		}
+		layout.Watermark = &watermark
+	}
+
+	//a change of the layout or of its template makes the cached manuals stale
+	b, err := json.Marshal(layout)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(append(b, tpl.version...))
+
+	return &manualLayout{
+		ManualLayout: layout,
+		version:      hex.EncodeToString(sum[:8]),
+		template:     tpl,
+		texts:        texts,
+	}, nil
+}
+
+// checkManualFont fills in the default font, and checks it is a core PDF font
+func checkManualFont(font, style *string, size *float64) error {
+	if *font == "" {
+		*font = "Arial"
+	}
+	switch strings.ToLower(*font) {
+	case "arial", "helvetica", "times", "courier":
+	default:
+		return fmt.Errorf("unknown font %s", *font)
+	}
+
+	*style = strings.ToUpper(*style)
+	if strings.Trim(*style, "BIU") != "" {
+		return fmt.Errorf("unknown font style %s", *style)
+	}
+
+	if *size <= 0 {
+		*size = 12
+	}
+	return nil
+}
+
+// forPlan returns the layout of the plan
+func (m *ManualLayouts) forPlan(planName string) *manualLayout {
+	if layout, ok := m.plans[strings.ToLower(planName)]; ok {
+		return layout
+	}
+	return m.def
+}
+
+// licenceKey derives the licence key of a user for a plan. The same user and plan
+// always get the same key, so it does not have to be stored.
+func (m *ManualLayouts) licenceKey(userID, planID int) string {
+	mac := hmac.New(sha256.New, m.secret)
+	fmt.Fprintf(mac, "licence:%d:%d", userID, planID)
+	key := base32.StdEncoding.EncodeToString(mac.Sum(nil))[:16]
+
+	return key[0:4] + "-" + key[4:8] + "-" + key[8:12] + "-" + key[12:16]
+}
+
+// text renders a text of the layout, a text that was never set is empty
+func (l *manualLayout) text(name string, values manualValues) (string, error) {
+	if l.texts.Lookup(name) == nil {
+		return "", nil
+	}
+
+	var buf strings.Builder
+	if err := l.texts.ExecuteTemplate(&buf, name, values); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// generateManual stamps the values on every page of the template of the layout
+func (app *Config) generateManual(layout *manualLayout, values manualValues) (*gofpdf.Fpdf, error) {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(10, 13, 10)
+	//fields near the bottom must not start a new page
+	pdf.SetAutoPageBreak(false, 0)
+
+	for name, set := range map[string]func(string, bool){
+		"title":    pdf.SetTitle,
+		"author":   pdf.SetAuthor,
+		"subject":  pdf.SetSubject,
+		"keywords": pdf.SetKeywords,
+	} {
+		text, err := layout.text(name, values)
+		if err != nil {
+			return nil, err
+		}
+		if text != "" {
+			set(text, true)
+		}
+	}
+	pdf.SetCreator("GoSub", false)
+
+	//the core fonts are not unicode, names are written in their code page
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	texts := make([]string, len(layout.Fields))
+	for i := range layout.Fields {
+		text, err := layout.text(fmt.Sprintf("field%d", i), values)
+		if err != nil {
+			return nil, err
+		}
+		texts[i] = tr(text)
+	}
+
+	watermark, err := layout.text("watermark", values)
+	if err != nil {
+		return nil, err
+	}
+	watermark = tr(watermark)
+
+	//the template pages were imported once at startup
+	layout.template.importInto(pdf)
+
+	for page := 1; page <= len(layout.template.pages); page++ {
+		pdf.AddPage()
+		layout.template.usePage(pdf, page)
+
+		for i, field := range layout.Fields {
+			if field.Page != 0 && field.Page != page {
+				continue
+			}
+
+			pdf.SetFont(field.Font, field.Style, field.Size)
+			pdf.SetTextColor(field.Color[0], field.Color[1], field.Color[2])
+			pdf.SetXY(field.X, field.Y)
+			pdf.MultiCell(field.Width, pdf.PointConvert(field.Size), texts[i], "", field.Align, false)
+		}
+
+		if layout.Watermark != nil && onManualPage(layout.Watermark.Pages, page) {
+			drawWatermark(pdf, layout.Watermark, watermark)
+		}
+	}
+
+	return pdf, pdf.Error()
+}
+
+// onManualPage returns true if page is one of pages, where no pages is all of them
+func onManualPage(pages []int, page int) bool {
+	if len(pages) == 0 {
+		return true
+	}
+	for _, p := range pages {
+		if p == page {
+			return true
+		}
+	}
+	return false
+}
+
+// drawWatermark writes the text across the middle of the current page
+func drawWatermark(pdf *gofpdf.Fpdf, watermark *ManualWatermark, text string) {
+	w, h := pdf.GetPageSize()
+
+	pdf.SetFont(watermark.Font, watermark.Style, watermark.Size)
+	pdf.SetTextColor(watermark.Color[0], watermark.Color[1], watermark.Color[2])
+	pdf.SetAlpha(watermark.Opacity, "Normal")
+
+	pdf.TransformBegin()
+	pdf.TransformRotate(watermark.Angle, w/2, h/2)
+	pdf.Text(w/2-pdf.GetStringWidth(text)/2, h/2+pdf.PointConvert(watermark.Size)/3, text)
+	pdf.TransformEnd()
+
+	pdf.SetAlpha(1, "Normal")
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the metrics are served on their own address, so they are never exposed with the
+// site. It is bound to the loopback interface unless ADMIN_ADDR says otherwise.
+const defaultAdminAddr = "127.0.0.1:8001"
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gosub",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, by route pattern, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gosub",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by route pattern and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	mailsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gosub",
+		Name:      "mail_sent_total",
+		Help:      "Mails handed to the SMTP relay.",
+	})
+
+	mailsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gosub",
+		Name:      "mail_failed_total",
+		Help:      "Mails that could not be built or sent.",
+	})
+
+	errorsReported = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gosub",
+		Name:      "errors_total",
+		Help:      "Errors received on the error channel.",
+	})
+
+	pdfDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gosub",
+		Name:      "pdf_generation_duration_seconds",
+		Help:      "Time taken to generate a PDF, by document.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"document"})
+)
+
+// newMetricsRegistry registers the metrics of the app, along with the ones read
+// from the mail queue and the database and redis pools when they are scraped
+func (app *Config) newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(app.DB, "postgres"),
+		httpRequests,
+		httpDuration,
+		mailsSent,
+		mailsFailed,
+		errorsReported,
+		pdfDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "gosub",
+			Name:      "mail_queue_depth",
+			Help:      "Mails waiting in the mailer channel.",
+		}, func() float64 {
+			return float64(len(app.Mailer.Mailerchan))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "gosub",
+			Name:      "redis_pool_active_connections",
+			Help:      "Connections of the redis pool, idle and in use.",
+		}, func() float64 {
+			return float64(app.Redis.ActiveCount())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "gosub",
+			Name:      "redis_pool_idle_connections",
+			Help:      "Idle connections of the redis pool.",
+		}, func() float64 {
+			return float64(app.Redis.IdleCount())
+		}),
+	)
+
+	return reg
+}
+
+// Metrics counts and times the requests by the route pattern chi matched, not
+// the path, so ids in the path do not make a series each
+func (app *Config) Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			//nothing was written, net/http sends a 200
+			status = http.StatusOK
+		}
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// adminRoutes are served on the admin address only. The probes are on the site
+// too, but only there does the readiness probe tell the result of every check.
+func (app *Config) adminRoutes() http.Handler {
+	mux := chi.NewRouter()
+	mux.Get("/healthz", app.Healthz)
+	mux.Get("/readyz", app.Readyz)
+	mux.Handle("/metrics", promhttp.HandlerFor(app.newMetricsRegistry(), promhttp.HandlerOpts{}))
+	return mux
+}
+
+// spinAdminServer starts serving the admin routes in the background
+func (app *Config) spinAdminServer() {
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = defaultAdminAddr
+	}
+
+	app.AdminServer = &http.Server{
+		Addr:    addr,
+		Handler: app.adminRoutes(),
+	}
+	app.Logger.Info("Starting admin server", "addr", addr)
+
+	go func() {
+		err := app.AdminServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.Logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}()
+}
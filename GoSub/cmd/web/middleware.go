@@ -1,9 +1,26 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"gosub/data"
+	"net/http"
+)
+
+// sessionLoadedKey marks the requests SessionLoad loaded the session of
+type sessionLoadedKey struct{}
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
-	return app.Session.LoadAndSave(next)
+	return app.Session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), sessionLoadedKey{}, true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+// sessionLoaded returns false for the requests that have no session to read, like
+// the ones whose session could not be loaded, or that panicked before SessionLoad
+func sessionLoaded(r *http.Request) bool {
+	loaded, _ := r.Context().Value(sessionLoadedKey{}).(bool)
+	return loaded
 }
 
 func (app *Config) Auth(next http.Handler) http.Handler {
@@ -16,3 +33,20 @@ func (app *Config) Auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (app *Config) AdminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+		if !ok || user.IsAdmin != 1 {
+			app.errorPage(w, r, http.StatusForbidden)
+			return
+		}
+
+		if user.TwoFactorEnabled != 1 && app.adminTwoFactorRequired(r.Context()) {
+			app.Session.Put(r.Context(), "warning", "Admins must set up two-factor authentication first")
+			http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
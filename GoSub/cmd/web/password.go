@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/validation"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const resetLinkMinutes = 60
+
+func (app *Config) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+// PostForgotPasswordPage mails a reset link. The answer is the same whether the
+// email is registered or not, so the form cannot be used to find accounts.
+func (app *Config) PostForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		app.render(w, r, "forgot-password.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	user, err := app.Models.User.GetByEmail(r.Context(), strings.TrimSpace(form.Get("email")))
+	if err == nil {
+		link, err := app.passwordResetURL(r.Context(), user)
+		if err != nil {
+			app.logError(r.Context(), err)
+		} else {
+			msg := Message{
+				To:       user.Email,
+				Subject:  "Reset your password!!",
+				Template: "reset-password-email",
+				Data:     template.HTML(link),
+			}
+			app.sendEmail(r.Context(), msg)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "If an account exists for that email, we have sent a link to reset the password")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (app *Config) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.verifyPasswordReset(w, r); !ok {
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["action"] = r.RequestURI
+
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) PostResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.verifyPasswordReset(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("password", "verify-password")
+	form.Password("password", app.Passwords, user.Email)
+	form.Matches("password", "verify-password", "Passwords do not match")
+
+	dataMap := make(map[string]any)
+	dataMap["action"] = r.RequestURI
+
+	if !form.Valid() {
+		app.render(w, r, "reset-password.page.gohtml", &TemplateData{Form: form, Data: dataMap})
+		return
+	}
+
+	err = user.ResetPassword(r.Context(), form.Get("password"))
+	if err != nil {
+		var pwErr *validation.PasswordError
+		if errors.As(err, &pwErr) {
+			form.Errors.Add("password", pwErr.Message())
+			app.render(w, r, "reset-password.page.gohtml", &TemplateData{Form: form, Data: dataMap})
+			return
+		}
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to reset password!!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	//a successful reset uses up the link, lifts any lockout, and signs out every
+	//session
+	if err = app.Models.LinkToken.Revoke(r.Context(), user.ID, data.LinkPasswordReset); err != nil {
+		app.logError(r.Context(), err)
+	}
+	if err = app.resetLoginFailures(user.Email); err != nil {
+		app.logError(r.Context(), err)
+	}
+	if err = app.revokeAllSessions(r.Context(), user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		ActorID:  user.ID,
+		Action:   data.AuditPasswordReset,
+		TargetID: user.ID,
+	})
+
+	app.Session.Put(r.Context(), "flash", "Password changed, you can log in now!!")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// verifyPasswordReset checks the signed reset link and its token, and returns its
+// user. The token is used up once the password is reset. On failure it has
+// already redirected to the login page.
+func (app *Config) verifyPasswordReset(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	testUrl := fmt.Sprintf("http://localhost:8000%s", r.RequestURI)
+	if !VerifyToken(testUrl) || Expired(testUrl, resetLinkMinutes) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+
+	token, err := app.Models.LinkToken.Find(r.Context(), data.LinkPasswordReset, r.URL.Query().Get("token"))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.logError(r.Context(), err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), token.UserID)
+	if err != nil || passwordVersion(user) != token.Payload["v"] {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// passwordResetURL issues a reset token for the user, and builds the signed link
+// that carries it
+func (app *Config) passwordResetURL(ctx context.Context, user *data.User) (string, error) {
+	token, err := app.Models.LinkToken.Issue(ctx, user.ID, data.LinkPasswordReset,
+		map[string]string{"v": passwordVersion(user)}, resetLinkMinutes*time.Minute)
+	if err != nil {
+		return "", err
+	}
+
+	link := fmt.Sprintf("http://localhost:8000/reset-password?token=%s", token)
+	return GenerateTokenFromString(link), nil
+}
+
+// passwordVersion fingerprints the current password hash. It is kept with the
+// reset token, so the link stops working as soon as the password has been changed.
+func passwordVersion(user *data.User) string {
+	sum := sha256.Sum256([]byte(user.Password))
+	return hex.EncodeToString(sum[:8])
+}
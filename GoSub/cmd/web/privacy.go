@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gosub/data"
+	"gosub/storage"
+	"gosub/validation"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//how long a user can change their mind after asking for deletion
+	accountDeletionDelay = 14 * 24 * time.Hour
+	//how long the link to a data export stays valid
+	exportLinkMinutes = 24 * 60
+	exportDir         = "./tmp/exports"
+)
+
+// PostAccountExport queues the data export of the user. The download link is
+// mailed once the ZIP is ready.
+func (app *Config) PostAccountExport(w http.ResponseWriter, r *http.Request) {
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot export the data of someone else!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	//one export at a time is enough
+	_, err = app.Jobs.Enqueue(r.Context(), jobDataExport, dataExportPayload{UserID: user.ID}, JobOptions{
+		UniqueKey: strconv.Itoa(user.ID),
+	})
+	if errors.Is(err, data.ErrDuplicateJob) {
+		app.Session.Put(r.Context(), "warning", "Your data is already being collected, you will get an email shortly!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to export your data!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditDataExported,
+		TargetID: user.ID,
+	})
+
+	app.Session.Put(r.Context(), "flash", "We are collecting your data, you will get an email with a download link shortly!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+// buildDataExport writes everything we hold about the user into a ZIP of JSON
+// files, and returns the name of the file
+func (app *Config) buildDataExport(ctx context.Context, user *data.User) (string, error) {
+	subscription, err := app.Models.Plan.GetSubscription(ctx, user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	history, err := app.Models.SubscriptionRecord.GetHistory(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	invoices, err := app.Models.Invoice.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	events, err := app.Models.AuditEvent.GetForUser(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	prefs, err := app.Models.NotificationPreferences.Get(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	sessions, err := app.Models.UserSession.GetActive(ctx, user.ID, time.Time{})
+	if err != nil {
+		return "", err
+	}
+
+	//the password hash and the two-factor secret are left out on purpose
+	profile := map[string]any{
+		"id":                 user.ID,
+		"email":              user.Email,
+		"first_name":         user.FirstName,
+		"last_name":          user.LastName,
+		"active":             user.Active == 1,
+		"two_factor_enabled": user.TwoFactorEnabled == 1,
+		"delete_after":       user.DeleteAfter,
+		"created_at":         user.CreatedAt,
+		"updated_at":         user.UpdatedAt,
+	}
+
+	files := []struct {
+		name  string
+		value any
+	}{
+		{"profile.json", profile},
+		{"subscription.json", subscription},
+		{"subscription_history.json", history},
+		{"invoices.json", invoices},
+		{"audit_events.json", events},
+		{"notification_preferences.json", prefs},
+		{"sessions.json", sessions},
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%d_%s.zip", user.ID, hex.EncodeToString(b))
+
+	if err = os.MkdirAll(exportDir, 0o700); err != nil {
+		return "", err
+	}
+
+	out, err := os.OpenFile(filepath.Join(exportDir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return "", err
+		}
+
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(file.value); err != nil {
+			return "", err
+		}
+	}
+
+	if err = archive.Close(); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// DownloadDataExport serves an export from a signed link. The link only works for
+// the user the export belongs to.
+func (app *Config) DownloadDataExport(w http.ResponseWriter, r *http.Request) {
+	testUrl := fmt.Sprintf("http://localhost:8000%s", r.RequestURI)
+	if !VerifyToken(testUrl) || Expired(testUrl, exportLinkMinutes) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	name := r.URL.Query().Get("file")
+	owner := strconv.Itoa(app.Session.GetInt(r.Context(), "userID")) + "_"
+	if app.Session.Exists(r.Context(), "impersonator") || filepath.Base(name) != name || !strings.HasPrefix(name, owner) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	path := filepath.Join(exportDir, name)
+	if _, err := os.Stat(path); err != nil {
+		app.Session.Put(r.Context(), "error", "This export is no longer available, please request a new one!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="my-data.zip"`)
+	http.ServeFile(w, r, path)
+}
+
+// dataExportURL builds the signed download link of an export
+func dataExportURL(name string) string {
+	link := fmt.Sprintf("http://localhost:8000/members/account/export/download?file=%s", url.QueryEscape(name))
+	return GenerateTokenFromString(link)
+}
+
+// PostAccountDelete schedules the account for deletion. Nothing is removed until
+// the cooling-off period has passed, and the user can cancel until then.
+func (app *Config) PostAccountDelete(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot delete the account of someone else!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	form := validation.New(r.PostForm)
+	form.Required("delete-password")
+
+	app.confirmPassword(r, form, "delete-password", user)
+
+	if !form.Valid() {
+		app.renderAccount(w, r, form)
+		return
+	}
+
+	deleteAfter := time.Now().Add(accountDeletionDelay)
+	err = user.ScheduleDeletion(r.Context(), deleteAfter)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to delete account!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	if err = app.refreshSessionUser(r, user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditDeletionScheduled,
+		TargetID: user.ID,
+		Payload:  map[string]any{"delete_after": deleteAfter},
+	})
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Data: fmt.Sprintf("Your account will be deleted on %s. If you change your mind, log in and cancel "+
+			"the deletion from your account page before then. If it wasn't you, change your password right away!!",
+			deleteAfter.Format("January 2, 2006")),
+	}
+	app.sendEmail(r.Context(), msg)
+
+	app.Session.Put(r.Context(), "flash", "Your account will be deleted on "+deleteAfter.Format("January 2, 2006"))
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+// PostAccountDeleteCancel keeps an account that was scheduled for deletion
+func (app *Config) PostAccountDeleteCancel(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	err = user.CancelDeletion(r.Context())
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to cancel the deletion!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	if err = app.refreshSessionUser(r, user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditDeletionCancelled,
+		TargetID: user.ID,
+	})
+
+	app.Session.Put(r.Context(), "flash", "Your account will not be deleted!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+// purgeDeletedAccounts deletes the accounts whose cooling-off period has ended
+func (app *Config) purgeDeletedAccounts(ctx context.Context) error {
+	users, err := app.Models.User.GetDueForDeletion(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err = app.revokeAllSessions(ctx, user.ID); err != nil {
+			app.logError(ctx, err)
+		}
+
+		//read before the invoices are anonymised
+		invoices, err := app.Models.Invoice.GetAllForUser(ctx, user.ID)
+		if err != nil {
+			app.logError(ctx, err)
+			continue
+		}
+
+		err = user.DeleteAccount(ctx)
+		if err != nil {
+			app.logError(ctx, err)
+			continue
+		}
+
+		//exports hold the same data, so they go too
+		exports, _ := filepath.Glob(filepath.Join(exportDir, fmt.Sprintf("%d_*.zip", user.ID)))
+		for _, export := range exports {
+			_ = os.Remove(export)
+		}
+
+		//so do the generated documents with the name and email on them
+		if err = app.deleteDocuments(ctx, user.ID, invoices); err != nil {
+			app.logError(ctx, err)
+		}
+
+		msg := Message{
+			To:      user.Email,
+			Subject: "Your account has been deleted",
+			Data:    "Your account and your personal data have been deleted. We are sorry to see you go!!",
+		}
+		app.sendEmail(ctx, msg)
+
+		app.Logger.InfoContext(ctx, "Deleted account", "deleted_user_id", user.ID)
+	}
+
+	return nil
+}
+
+// deleteDocuments removes the manuals and the invoice PDFs of a user from the
+// blob store. The invoice records stay, anonymised, and their PDFs are made again
+// from them when needed.
+func (app *Config) deleteDocuments(ctx context.Context, userID int, invoices []*data.Invoice) error {
+	ctx, cancel := context.WithTimeout(ctx, blobTimeout)
+	defer cancel()
+
+	err := storage.DeletePrefix(ctx, app.Blobs, fmt.Sprintf("%s%d_", manualsPrefix, userID))
+	if err != nil {
+		return err
+	}
+
+	for _, invoice := range invoices {
+		if err = app.Blobs.Delete(ctx, invoiceKey(invoice.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
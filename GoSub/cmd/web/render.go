@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"gosub/data"
+	"gosub/validation"
 	"html/template"
+	"io"
 	"net/http"
 	"time"
 )
@@ -18,9 +21,24 @@ type TemplateData struct {
 	Authenticated bool
 	Now           time.Time
 	User          *data.User
+	Impersonator  *data.User
+	CSRFToken     string
+	Form          *validation.Form
 }
 
+// render writes the page, or the server error page if the page can not be made.
+// The page is made in full first, so a broken template never sends half a page.
 func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
+	var buf bytes.Buffer
+	if err := app.renderTo(&buf, r, t, td); err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	buf.WriteTo(w)
+}
+
+func (app *Config) renderTo(w io.Writer, r *http.Request, t string, td *TemplateData) error {
 	//we will need that for every template
 	partials := []string{
 		fmt.Sprintf("%s/base.layout.gohtml", pathToTemplates),
@@ -45,21 +63,24 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 	//create template
 	tmpl, err := template.ParseFiles(templatesSlice...)
 	if err != nil {
-		app.ErrorLog.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	//inject data in template and send to client
-	if err = tmpl.Execute(w, app.AddDefaultData(td, r)); err != nil {
-		app.ErrorLog.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	//inject data in template
+	return tmpl.Execute(w, app.AddDefaultData(td, r))
 }
 
-// add default data to template data state
+// add default data to template data state. The error pages of requests without a
+// session only get the data that does not come from it.
 func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateData {
+	if td.Form == nil {
+		td.Form = validation.New(nil)
+	}
+	td.Now = time.Now()
+	if !sessionLoaded(r) {
+		return td
+	}
+
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 	td.Warning = app.Session.PopString(r.Context(), "warning")
 	td.Error = app.Session.PopString(r.Context(), "error")
@@ -67,12 +88,17 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 		td.Authenticated = true
 		user, ok := app.Session.Get(r.Context(), "user").(data.User)
 		if !ok {
-			app.ErrorLog.Println("Cannot get user from session")
+			app.Logger.ErrorContext(r.Context(), "Cannot get user from session")
 		} else {
 			td.User = &user
 		}
+
+		impersonator, ok := app.Session.Get(r.Context(), "impersonator").(data.User)
+		if ok {
+			td.Impersonator = &impersonator
+		}
 	}
-	td.Now = time.Now()
+	td.CSRFToken = app.csrfToken(r)
 
 	return td
 }
@@ -11,18 +11,46 @@ func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	//setup middleware
-	mux.Use(middleware.Recoverer)
+	mux.Use(app.Probes)
+	mux.Use(app.Tracing)
+	mux.Use(middleware.RequestID)
+	//early, so a panic of the middleware after it gets the error page too
+	mux.Use(app.Recoverer)
 	mux.Use(app.SessionLoad)
+	mux.Use(app.RequestLogger)
+	mux.Use(app.Metrics)
+	mux.Use(app.CheckSession)
+	mux.Use(app.VerifyCSRF)
+
+	//the error pages, the mounted routers use them too
+	mux.NotFound(app.NotFound)
+	mux.MethodNotAllowed(app.MethodNotAllowed)
 
 	//define routes
 	mux.Get("/", app.HomePage)
 	mux.Get("/login", app.LoginPage)
 	mux.Post("/login", app.PostLoginPage)
-	mux.Get("/logout", app.Logout)
+	mux.Get("/login/two-factor", app.TwoFactorPage)
+	mux.Post("/login/two-factor", app.PostTwoFactorPage)
+	mux.Post("/logout", app.Logout)
 	mux.Get("/register", app.RegisterPage)
 	mux.Post("/register", app.PostRegisterPage)
 	mux.Get("/activate", app.ActivateAccount)
+	mux.Get("/activate/resend", app.ResendActivationPage)
+	mux.Post("/activate/resend", app.PostResendActivationPage)
+	mux.Get("/unlock", app.UnlockAccount)
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.PostForgotPasswordPage)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.PostResetPasswordPage)
+	mux.Get("/confirm-email", app.ConfirmEmailChange)
 	mux.Mount("/members", app.authRouter())
+	mux.Mount("/admin", app.adminRouter())
+
+	//a local blob store serves its own signed links, S3 links go to the store
+	if handler, ok := app.Blobs.(http.Handler); ok {
+		mux.Handle(localBlobsPath+"/*", http.StripPrefix(localBlobsPath, handler))
+	}
 
 	return mux
 }
@@ -31,6 +59,39 @@ func (app *Config) authRouter() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(app.Auth)
 	mux.Get("/plans", app.ChooseSubscription)
-	mux.Get("/subscribe", app.SubscribeToPlan)
+	mux.Post("/subscribe", app.SubscribeToPlan)
+	mux.Get("/documents", app.DocumentsPage)
+	mux.Get("/documents/manual", app.DownloadManual)
+	mux.Get("/documents/invoice", app.DownloadInvoice)
+	mux.Post("/impersonate/stop", app.StopImpersonation)
+	mux.Get("/two-factor", app.TwoFactorSetupPage)
+	mux.Post("/two-factor/enable", app.EnableTwoFactor)
+	mux.Post("/two-factor/disable", app.DisableTwoFactor)
+	mux.Get("/email", app.ChangeEmailPage)
+	mux.Post("/email", app.PostChangeEmailPage)
+	mux.Get("/account", app.AccountPage)
+	mux.Post("/account/profile", app.PostAccountProfile)
+	mux.Post("/account/password", app.PostAccountPassword)
+	mux.Post("/account/notifications", app.PostAccountNotifications)
+	mux.Post("/account/sessions/sign-out", app.PostSignOutSession)
+	mux.Post("/account/sessions/sign-out-others", app.PostSignOutOtherSessions)
+	mux.Post("/account/export", app.PostAccountExport)
+	mux.Get("/account/export/download", app.DownloadDataExport)
+	mux.Post("/account/delete", app.PostAccountDelete)
+	mux.Post("/account/delete/cancel", app.PostAccountDeleteCancel)
+	return mux
+}
+
+func (app *Config) adminRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.Auth)
+	mux.Use(app.AdminOnly)
+	mux.Get("/users", app.AdminUsersPage)
+	mux.Post("/impersonate", app.StartImpersonation)
+	mux.Get("/audit", app.AdminAuditPage)
+	mux.Get("/jobs", app.AdminJobsPage)
+	mux.Post("/jobs/retry", app.PostRetryJob)
+	mux.Get("/settings", app.AdminSettingsPage)
+	mux.Post("/settings", app.PostAdminSettingsPage)
 	return mux
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gosub/data"
+	"gosub/logging"
+	"gosub/reporting"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Scheduler runs recurring tasks on cron expressions. Every run takes a Postgres
+// advisory lock named after the task, so with several instances of the app only
+// one of them runs a task at a time, and records the slot of the schedule it
+// runs for, so an instance whose clock fires later skips the slot that already ran.
+type Scheduler struct {
+	cron      *cron.Cron
+	ErrorChan chan error
+	Logger    *slog.Logger
+}
+
+// NewScheduler returns a scheduler with no tasks
+func NewScheduler(errorChan chan error, logger *slog.Logger) *Scheduler {
+	return &Scheduler{
+		cron:      cron.New(),
+		ErrorChan: errorChan,
+		Logger:    logger,
+	}
+}
+
+// Add schedules a task with a standard five field cron expression. The expression
+// can be overridden with SCHEDULE_<NAME>, where "off" disables the task. Records
+// the task logs with its context carry the task name.
+func (s *Scheduler) Add(name, spec string, task func(ctx context.Context) error) error {
+	env := "SCHEDULE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if v := os.Getenv(env); v != "" {
+		spec = v
+	}
+	if spec == "off" {
+		s.Logger.Info("Task is disabled", "task", name)
+		return nil
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return fmt.Errorf("task %s: %w", name, err)
+	}
+
+	s.cron.Schedule(schedule, cron.FuncJob(func() {
+		s.run(name, scheduleSlot(schedule, time.Now()), task)
+	}))
+
+	return nil
+}
+
+// scheduleSlot returns the time the run firing now was scheduled for. Cron fires
+// at the slot itself, give or take the precision of the timer, and the
+// schedules are in whole minutes.
+func scheduleSlot(schedule cron.Schedule, now time.Time) time.Time {
+	return schedule.Next(now.Add(-time.Minute))
+}
+
+// Start runs the tasks in the background
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+// Stop stops scheduling new runs, and waits for the running ones to finish
+func (s *Scheduler) Stop() {
+	<-s.cron.Stop().Done()
+}
+
+func (s *Scheduler) run(name string, slot time.Time, task func(ctx context.Context) error) {
+	ctx := logging.With(context.Background(), "task", name)
+	ctx, span := tracer.Start(ctx, "task "+name)
+	defer span.End()
+
+	lock, ok, err := data.TryAdvisoryLock(ctx, "scheduler:"+name)
+	if err != nil {
+		s.ErrorChan <- reporting.Wrap(ctx, fmt.Errorf("task %s: %w", name, err))
+		return
+	}
+	if !ok {
+		//another instance is running it
+		return
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			s.ErrorChan <- reporting.Wrap(ctx, fmt.Errorf("task %s: %w", name, err))
+		}
+	}()
+
+	//the slot counts as run even if the task fails, it is tried again on the next one
+	first, err := data.ClaimTaskRun(ctx, name, slot)
+	if err != nil {
+		s.ErrorChan <- reporting.Wrap(ctx, fmt.Errorf("task %s: %w", name, err))
+		return
+	}
+	if !first {
+		//another instance ran this slot already
+		return
+	}
+
+	err = runTask(ctx, task)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		s.ErrorChan <- reporting.Wrap(ctx, fmt.Errorf("task %s: %w", name, err))
+	}
+}
+
+// runTask turns a panic of the task into an error with the stack of the panic, so
+// one bad run does not take the scheduler down
+func runTask(ctx context.Context, task func(ctx context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = reporting.Recovered(p)
+		}
+	}()
+
+	return task(ctx)
+}
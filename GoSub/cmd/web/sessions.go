@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"gosub/data"
+	"net/http"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	sessionLifetime      = 24 * time.Hour
+	sessionTouchInterval = 5 * time.Minute
+)
+
+// revoked sessions are kept in redis for as long as a session can live, so every
+// request can be checked without going to the database
+func revokedSessionKey(id string) string {
+	return "session:revoked:" + id
+}
+
+// startUserSession records the login of the user with the device and IP it came from
+func (app *Config) startUserSession(r *http.Request, user *data.User) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		app.logError(r.Context(), err)
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	err := app.Models.UserSession.Insert(r.Context(), data.UserSession{
+		ID:     id,
+		UserID: user.ID,
+		Device: r.UserAgent(),
+		IP:     clientIP(r),
+	})
+	if err != nil {
+		app.logError(r.Context(), err)
+		return
+	}
+
+	app.Session.Put(r.Context(), "sessionID", id)
+	app.Session.Put(r.Context(), "lastSeen", time.Now().Unix())
+}
+
+// endUserSession marks the current session as ended, when the user logs out
+func (app *Config) endUserSession(r *http.Request) {
+	id := app.Session.GetString(r.Context(), "sessionID")
+	if id == "" {
+		return
+	}
+
+	ids, err := app.Models.UserSession.Revoke(r.Context(), app.sessionOwner(r), id)
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+	app.markSessionsRevoked(r.Context(), ids)
+}
+
+// sessionOwner returns the user who logged in to the session, which is the
+// admin and not the impersonated user while impersonating
+func (app *Config) sessionOwner(r *http.Request) int {
+	if admin, ok := app.Session.Get(r.Context(), "impersonator").(data.User); ok {
+		return admin.ID
+	}
+	return app.Session.GetInt(r.Context(), "userID")
+}
+
+func (app *Config) markSessionsRevoked(ctx context.Context, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		_, err := conn.Do("SET", revokedSessionKey(id), 1, "EX", int(sessionLifetime.Seconds()))
+		if err != nil {
+			app.logError(ctx, err)
+		}
+	}
+}
+
+// CheckSession signs out sessions that were revoked from another device, and
+// keeps the last seen time of the others up to date
+func (app *Config) CheckSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := app.Session.GetString(r.Context(), "sessionID")
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		conn := app.Redis.Get()
+		revoked, err := redis.Bool(conn.Do("EXISTS", revokedSessionKey(id)))
+		conn.Close()
+		if err != nil {
+			app.logError(r.Context(), err)
+		}
+
+		if revoked {
+			app.Session.Destroy(r.Context())
+			app.Session.RenewToken(r.Context())
+			app.Session.Put(r.Context(), "error", "You have been signed out")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		lastSeen := time.Unix(app.Session.GetInt64(r.Context(), "lastSeen"), 0)
+		if time.Since(lastSeen) > sessionTouchInterval {
+			if err := app.Models.UserSession.Touch(r.Context(), id); err != nil {
+				app.logError(r.Context(), err)
+			}
+			app.Session.Put(r.Context(), "lastSeen", time.Now().Unix())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revokeOtherSessions signs the user out everywhere but in the current session
+func (app *Config) revokeOtherSessions(r *http.Request, userID int) error {
+	ids, err := app.Models.UserSession.RevokeOthers(r.Context(), userID, app.Session.GetString(r.Context(), "sessionID"))
+	if err != nil {
+		return err
+	}
+	app.markSessionsRevoked(r.Context(), ids)
+	return nil
+}
+
+// revokeAllSessions signs the user out everywhere
+func (app *Config) revokeAllSessions(ctx context.Context, userID int) error {
+	ids, err := app.Models.UserSession.RevokeAll(ctx, userID)
+	if err != nil {
+		return err
+	}
+	app.markSessionsRevoked(ctx, ids)
+	return nil
+}
+
+func (app *Config) PostSignOutSession(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot sign out sessions while logged in as someone else!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+	ids, err := app.Models.UserSession.Revoke(r.Context(), userID, r.Form.Get("id"))
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to sign out session!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+	app.markSessionsRevoked(r.Context(), ids)
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditSessionsRevoked,
+		TargetID: userID,
+		Payload:  map[string]any{"sessions": len(ids)},
+	})
+
+	app.Session.Put(r.Context(), "flash", "Session signed out!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
+
+func (app *Config) PostSignOutOtherSessions(w http.ResponseWriter, r *http.Request) {
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot sign out sessions while logged in as someone else!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+	err := app.revokeOtherSessions(r, userID)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to sign out other sessions!!")
+		http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditSessionsRevoked,
+		TargetID: userID,
+		Payload:  map[string]any{"others": true},
+	})
+
+	app.Session.Put(r.Context(), "flash", "Signed out of all other sessions!!")
+	http.Redirect(w, r, "/members/account", http.StatusSeeOther)
+}
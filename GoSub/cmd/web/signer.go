@@ -7,19 +7,23 @@ import (
 	"time"
 )
 
-const secret = "abc123abc123abc123"
-
 var secretKey []byte
 
-// NewURLSigner creates a new signer
-func NewURLSigner() {
-	secretKey = []byte(secret)
+// NewURLSigner sets the key the links are signed with. It is called once at
+// startup, before any link is made or checked.
+func NewURLSigner(key []byte) {
+	secretKey = key
 }
 
 // GenerateTokenFromString generates a signed token
 func GenerateTokenFromString(data string) string {
 	var urlToSign string
 
+	//an empty key signs links anyone can make
+	if len(secretKey) == 0 {
+		panic("the URL signer has no key")
+	}
+
 	s := goalone.New(secretKey, goalone.Timestamp)
 	if strings.Contains(data, "?") {
 		urlToSign = fmt.Sprintf("%s&hash=", data)
@@ -35,6 +39,10 @@ func GenerateTokenFromString(data string) string {
 
 // VerifyToken verifies a signed token
 func VerifyToken(token string) bool {
+	if len(secretKey) == 0 {
+		return false
+	}
+
 	s := goalone.New(secretKey, goalone.Timestamp)
 	_, err := s.Unsign([]byte(token))
 	return err == nil
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	//how long generated files are kept in ./tmp; exports stay as long as their link works
+	tmpMaxAge = exportLinkMinutes * time.Minute
+	//how long before a renewal the reminder goes out
+	renewalReminderLead = 3 * 24 * time.Hour
+	//how long ended sessions are listed before they are purged
+	sessionRetention = 30 * 24 * time.Hour
+	//how long finished jobs are kept for the jobs page
+	jobRetention = 14 * 24 * time.Hour
+	//how long the reminders of past renewals are kept
+	renewalReminderRetention = 7 * 24 * time.Hour
+)
+
+// registerTasks schedules every recurring task. A bad expression is a
+// configuration error, so it stops the app at startup.
+func (app *Config) registerTasks() {
+	tasks := []struct {
+		name string
+		spec string
+		run  func(ctx context.Context) error
+	}{
+		{"purge-deleted-accounts", "0 * * * *", app.purgeDeletedAccounts},
+		{"remind-inactive-accounts", "15 * * * *", app.remindInactiveAccounts},
+		{"purge-inactive-accounts", "30 * * * *", app.purgeInactiveAccounts},
+		{"clean-tmp", "45 * * * *", app.cleanTmp},
+		{"clean-manuals", "50 * * * *", app.cleanManuals},
+		{"renewal-reminders", "0 9 * * *", app.sendRenewalReminders},
+		{"purge-sessions", "0 3 * * *", app.purgeSessions},
+		{"purge-jobs", "30 3 * * *", app.purgeJobs},
+		{"purge-renewal-reminders", "45 3 * * *", app.purgeRenewalReminders},
+		{"requeue-stale-jobs", "*/5 * * * *", app.Jobs.RequeueStale},
+		//every instance keeps its own errors, so each one runs its own digest
+		{"error-digest:" + instanceName(), "55 * * * *", app.sendErrorDigest},
+	}
+
+	for _, task := range tasks {
+		if err := app.Scheduler.Add(task.name, task.spec, task.run); err != nil {
+			app.Logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+}
+
+// cleanTmp deletes the generated files in ./tmp that are older than tmpMaxAge
+func (app *Config) cleanTmp(ctx context.Context) error {
+	now := time.Now()
+
+	return filepath.WalkDir("./tmp", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if now.Sub(info.ModTime()) > tmpMaxAge {
+			if err = os.Remove(path); err != nil {
+				app.logError(ctx, err)
+			}
+		}
+		return nil
+	})
+}
+
+// cleanManuals deletes the cached manuals older than manualCacheMaxAge from the
+// blob store
+func (app *Config) cleanManuals(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, blobTimeout)
+	defer cancel()
+
+	manuals, err := app.Blobs.List(ctx, manualsPrefix)
+	if err != nil {
+		return err
+	}
+
+	for _, manual := range manuals {
+		if time.Since(manual.ModTime) > manualCacheMaxAge {
+			if err = app.Blobs.Delete(ctx, manual.Key); err != nil {
+				app.logError(ctx, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// sendRenewalReminders mails users whose subscription renews within
+// renewalReminderLead, once per renewal
+func (app *Config) sendRenewalReminders(ctx context.Context) error {
+	notices, err := app.Models.RenewalNotice.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, notice := range notices {
+		renewal := notice.NextRenewal()
+		if time.Until(renewal) > renewalReminderLead {
+			continue
+		}
+
+		first, err := notice.MarkSent(ctx, renewal)
+		if err != nil {
+			app.logError(ctx, err)
+			continue
+		}
+		if !first {
+			continue
+		}
+
+		msg := Message{
+			To:      notice.Email,
+			Subject: "Your subscription renews soon",
+			Data: "Hi " + notice.FirstName + ", your " + notice.Plan.PlanName + " subscription renews on " +
+				renewal.Format("January 2, 2006") + " for " + notice.Plan.PlanAmountFormatted + ". " +
+				"You can change your plan or turn these reminders off from your account page.",
+		}
+		app.sendEmail(ctx, msg)
+	}
+
+	return nil
+}
+
+// sendErrorDigest mails the admins the errors this instance reported since the
+// last digest, grouped by fingerprint. If the admins cannot be read, the groups
+// are put back for the next digest.
+func (app *Config) sendErrorDigest(ctx context.Context) error {
+	groups := app.Errors.Digest()
+	if len(groups) == 0 {
+		return nil
+	}
+
+	admins, err := app.Models.User.GetAdmins(ctx)
+	if err != nil {
+		app.Errors.Restore(groups)
+		return err
+	}
+
+	total := 0
+	for _, g := range groups {
+		total += g.Count
+	}
+
+	for _, admin := range admins {
+		msg := Message{
+			To:       admin.Email,
+			Subject:  fmt.Sprintf("%d errors on %s", total, instanceName()),
+			Template: "error-digest",
+			DataMap: map[string]any{
+				"instance": instanceName(),
+				"total":    total,
+				"groups":   groups,
+			},
+		}
+		app.sendEmail(ctx, msg)
+	}
+
+	return nil
+}
+
+// instanceName tells the instances of the app apart in the error digests
+func instanceName() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}
+
+// purgeSessions deletes the session records that are no longer shown to anyone
+func (app *Config) purgeSessions(ctx context.Context) error {
+	n, err := app.Models.UserSession.PurgeBefore(ctx, time.Now().Add(-sessionRetention))
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		app.Logger.InfoContext(ctx, "Purged sessions", "count", n)
+	}
+	return nil
+}
+
+// purgeJobs deletes old finished jobs
+func (app *Config) purgeJobs(ctx context.Context) error {
+	n, err := app.Models.Job.PurgeFinished(ctx, time.Now().Add(-jobRetention))
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		app.Logger.InfoContext(ctx, "Purged jobs", "count", n)
+	}
+	return nil
+}
+
+// purgeRenewalReminders deletes the records of the reminders of past renewals
+func (app *Config) purgeRenewalReminders(ctx context.Context) error {
+	n, err := app.Models.RenewalNotice.PurgeBefore(ctx, time.Now().Add(-renewalReminderRetention))
+	if err != nil {
+		return err
+	}
+
+	if n > 0 {
+		app.Logger.InfoContext(ctx, "Purged renewal reminders", "count", n)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"gosub/data"
+	"gosub/validation"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// login throttling settings. Failed attempts are counted per account and per IP
+// inside a sliding window; once past the free attempts every failure doubles the
+// wait before the next try, and at the lock threshold the key is locked out.
+const (
+	loginWindow         = 15 * time.Minute
+	lockoutDuration     = 30 * time.Minute
+	maxLoginDelay       = time.Minute
+	accountFreeAttempts = 3
+	accountLockAttempts = 10
+	ipFreeAttempts      = 10
+	ipLockAttempts      = 50
+	unlockLinkMinutes   = 60
+)
+
+func accountKey(email string) string {
+	return "login:account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "login:ip:" + ip
+}
+
+// loginWait returns how long the account or the IP has to wait before
+// trying to log in again. Zero means the attempt is allowed.
+func (app *Config) loginWait(email, ip string) (time.Duration, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	var wait time.Duration
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		for _, suffix := range []string{":lock", ":wait"} {
+			ms, err := redis.Int64(conn.Do("PTTL", key+suffix))
+			if err != nil {
+				return 0, err
+			}
+			if d := time.Duration(ms) * time.Millisecond; d > wait {
+				wait = d
+			}
+		}
+	}
+
+	return wait, nil
+}
+
+// loginFailed counts a failed attempt for the account and the IP. It returns true
+// only for the attempt that locked the account, so the unlock mail goes out once.
+func (app *Config) loginFailed(email, ip string) (bool, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	accountLocked, err := countFailure(conn, accountKey(email), accountFreeAttempts, accountLockAttempts)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = countFailure(conn, ipKey(ip), ipFreeAttempts, ipLockAttempts)
+	if err != nil {
+		return false, err
+	}
+
+	return accountLocked, nil
+}
+
+func countFailure(conn redis.Conn, key string, free, lock int) (bool, error) {
+	count, err := redis.Int(conn.Do("INCR", key+":count"))
+	if err != nil {
+		return false, err
+	}
+
+	if count == 1 {
+		_, err = conn.Do("PEXPIRE", key+":count", loginWindow.Milliseconds())
+		if err != nil {
+			return false, err
+		}
+	}
+
+	//past the threshold too, in case the lock expired before the counter
+	if count >= lock {
+		_, err = conn.Do("SET", key+":lock", 1, "PX", lockoutDuration.Milliseconds())
+		return count == lock, err
+	}
+
+	if count > free {
+		_, err = conn.Do("SET", key+":wait", 1, "PX", loginDelay(count-free).Milliseconds())
+		return false, err
+	}
+
+	return false, nil
+}
+
+// loginDelay doubles the wait for every failure past the free attempts
+func loginDelay(extra int) time.Duration {
+	if extra > 6 {
+		return maxLoginDelay
+	}
+
+	delay := time.Second << (extra - 1)
+	if delay > maxLoginDelay {
+		return maxLoginDelay
+	}
+	return delay
+}
+
+// confirmPassword checks the password a logged in user enters again to confirm a
+// change. It goes through the same throttle as the login, on the email of the
+// user, so a stolen session cannot be used to guess the password. The problem,
+// if any, is added to the field of the form.
+func (app *Config) confirmPassword(r *http.Request, form *validation.Form, field string, user *data.User) {
+	if !form.Has(field) {
+		return
+	}
+
+	wait, err := app.loginWait(user.Email, clientIP(r))
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+	if wait > 0 {
+		form.Errors.Add(field, fmt.Sprintf("Too many failed attempts. Try again in %s", formatWait(wait)))
+		return
+	}
+
+	match, err := user.PasswordMatches(r.Context(), form.Get(field))
+	if err != nil {
+		app.logError(r.Context(), err)
+		form.Errors.Add(field, "Unable to check the password, try again")
+		return
+	}
+	if !match {
+		app.loginFailedAttempt(r, user.Email, user)
+		form.Errors.Add(field, "Wrong password!!")
+	}
+}
+
+// resetLoginFailures clears the counters and the lock of an account
+func (app *Config) resetLoginFailures(email string) error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	key := accountKey(email)
+	_, err := conn.Do("DEL", key+":count", key+":wait", key+":lock")
+	return err
+}
+
+// formatWait rounds a wait up to whole seconds for display
+func formatWait(d time.Duration) string {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds >= 60 {
+		return fmt.Sprintf("%d minutes", (seconds+59)/60)
+	}
+	return fmt.Sprintf("%d seconds", seconds)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of the app. Without a collector configured the spans
+// are not recorded, but the trace context still travels.
+var tracer = otel.Tracer("gosub/cmd/web")
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Tracing starts the span of a request, under the trace of the caller if it sent
+// one. The span is named after the route pattern chi matched, not the path.
+func (app *Config) Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+			span.SetName(r.Method + " " + rctx.RoutePattern())
+			span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// injectTraceContext returns the trace context of ctx in the form of the
+// propagators, to be stored with work that runs later
+func injectTraceContext(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// extractTraceContext returns ctx under the trace stored by injectTraceContext
+func extractTraceContext(ctx context.Context, traceContext map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(traceContext))
+}
+
+// tracedStore starts a span for every load, save and delete of a session in the
+// store it wraps. scs passes the context of the request to a store that takes one.
+type tracedStore struct {
+	scs.Store
+}
+
+func (s tracedStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	_, span := s.start(ctx, "session.load")
+	b, found, err := s.Store.Find(token)
+	endSpan(span, err)
+	return b, found, err
+}
+
+func (s tracedStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	_, span := s.start(ctx, "session.save")
+	err := s.Store.Commit(token, b, expiry)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStore) DeleteCtx(ctx context.Context, token string) error {
+	_, span := s.start(ctx, "session.delete")
+	err := s.Store.Delete(token)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStore) start(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis),
+	)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"gosub/data"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	totpIssuer         = "GoSub"
+	recoveryCodeCount  = 10
+	twoFactorLoginTime = 5 * time.Minute
+)
+
+func (app *Config) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	if !app.Session.Exists(r.Context(), "twoFactorUserID") {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "two-factor.page.gohtml", nil)
+}
+
+// PostTwoFactorPage is the second step of the login for users with 2FA enabled.
+// It accepts either a code from the authenticator app or an unused recovery code.
+func (app *Config) PostTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	//the password step has to be recent
+	id := app.Session.GetInt(r.Context(), "twoFactorUserID")
+	started := time.Unix(app.Session.GetInt64(r.Context(), "twoFactorStarted"), 0)
+	if id == 0 || time.Since(started) > twoFactorLoginTime {
+		app.clearTwoFactorLogin(r)
+		app.Session.Put(r.Context(), "error", "Your login has expired, please log in again")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), id)
+	if err != nil {
+		app.clearTwoFactorLogin(r)
+		app.Session.Put(r.Context(), "error", "No user found!!!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	wait, err := app.loginWait(user.Email, clientIP(r))
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+	if wait > 0 {
+		app.clearTwoFactorLogin(r)
+		app.Session.Put(r.Context(), "error", "Too many failed login attempts. Try again in "+formatWait(wait))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	method, err := app.checkSecondFactor(r.Context(), user, r.Form.Get("code"))
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	if method == "" {
+		_ = app.audit(r, data.AuditEvent{
+			Action:   data.AuditTwoFactorFailed,
+			TargetID: user.ID,
+		})
+		app.loginFailedAttempt(r, user.Email, user)
+		app.Session.Put(r.Context(), "error", "Invalid code!!")
+		http.Redirect(w, r, "/login/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	if method == "recovery_code" {
+		remaining, err := user.RemainingRecoveryCodes(r.Context())
+		if err != nil {
+			app.logError(r.Context(), err)
+		}
+		app.Session.Put(r.Context(), "warning", "You logged in with a recovery code, you have "+strconv.Itoa(remaining)+" left")
+	}
+
+	app.clearTwoFactorLogin(r)
+	app.Session.RenewToken(r.Context())
+	app.completeLogin(w, r, user, method)
+}
+
+func (app *Config) clearTwoFactorLogin(r *http.Request) {
+	app.Session.Remove(r.Context(), "twoFactorUserID")
+	app.Session.Remove(r.Context(), "twoFactorStarted")
+}
+
+// checkSecondFactor returns how the user proved the second factor, or an
+// empty string if the code is neither a valid TOTP code nor a recovery code
+func (app *Config) checkSecondFactor(ctx context.Context, user *data.User, code string) (string, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return "", nil
+	}
+
+	secret, err := user.GetTOTPSecret(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	if step, ok := validateTOTP(code, secret, time.Now()); ok {
+		//a code is valid for its whole window, it is only let in once
+		fresh, err := user.UseTOTPStep(ctx, step)
+		if err != nil || !fresh {
+			return "", err
+		}
+		return "totp", nil
+	}
+
+	ok, err := user.UseRecoveryCode(ctx, code)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	return "recovery_code", nil
+}
+
+func (app *Config) TwoFactorSetupPage(w http.ResponseWriter, r *http.Request) {
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["enabled"] = user.TwoFactorEnabled == 1
+
+	if user.TwoFactorEnabled == 1 {
+		remaining, err := user.RemainingRecoveryCodes(r.Context())
+		if err != nil {
+			app.logError(r.Context(), err)
+		}
+		dataMap["remaining"] = remaining
+	} else {
+		//keep the same secret until enrollment is confirmed, so reloading
+		//the page does not invalidate an already scanned QR code
+		key, err := app.pendingTOTPKey(r, user)
+		if err != nil {
+			app.logError(r.Context(), err)
+			app.Session.Put(r.Context(), "error", "Unable to set up two-factor authentication!!")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		qr, err := qrCode(key)
+		if err != nil {
+			app.logError(r.Context(), err)
+		}
+		dataMap["qr"] = qr
+		dataMap["secret"] = key.Secret()
+	}
+
+	app.render(w, r, "two-factor-setup.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot change two-factor settings while logged in as someone else!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	key, err := app.pendingTOTPKey(r, user)
+	var step int64
+	if err == nil {
+		step, err = enrollmentStep(strings.TrimSpace(r.Form.Get("code")), key.Secret())
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Invalid code, scan the QR code and try again!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to enable two-factor authentication!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err = user.EnableTwoFactor(r.Context(), key.Secret(), step, codes)
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to enable two-factor authentication!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "totpURL")
+	if err = app.refreshSessionUser(r, user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditTwoFactorEnabled,
+		TargetID: user.ID,
+	})
+
+	//the codes are only shown this once, so render instead of redirecting
+	dataMap := make(map[string]any)
+	dataMap["codes"] = codes
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication enabled!!")
+	app.render(w, r, "two-factor-codes.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	if app.Session.Exists(r.Context(), "impersonator") {
+		app.Session.Put(r.Context(), "error", "You cannot change two-factor settings while logged in as someone else!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(r.Context(), app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Error getting user from database!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	if user.IsAdmin == 1 && app.adminTwoFactorRequired(r.Context()) {
+		app.Session.Put(r.Context(), "error", "Two-factor authentication is required for admins!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	method, err := app.checkSecondFactor(r.Context(), user, r.Form.Get("code"))
+	if err != nil {
+		app.logError(r.Context(), err)
+	}
+	if method == "" {
+		app.Session.Put(r.Context(), "error", "Invalid code!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	err = user.DisableTwoFactor(r.Context())
+	if err != nil {
+		app.logError(r.Context(), err)
+		app.Session.Put(r.Context(), "error", "Unable to disable two-factor authentication!!")
+		http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	if err = app.refreshSessionUser(r, user.ID); err != nil {
+		app.logError(r.Context(), err)
+	}
+
+	_ = app.audit(r, data.AuditEvent{
+		Action:   data.AuditTwoFactorDisabled,
+		TargetID: user.ID,
+	})
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication disabled!!")
+	http.Redirect(w, r, "/members/two-factor", http.StatusSeeOther)
+}
+
+// pendingTOTPKey returns the key being enrolled, creating one if needed
+func (app *Config) pendingTOTPKey(r *http.Request, user *data.User) (*otp.Key, error) {
+	if url := app.Session.GetString(r.Context(), "totpURL"); url != "" {
+		return otp.NewKeyFromURL(url)
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	app.Session.Put(r.Context(), "totpURL", key.URL())
+	return key, nil
+}
+
+// enrollmentStep returns the step of the code confirming an enrollment
+func enrollmentStep(code, secret string) (int64, error) {
+	step, ok := validateTOTP(code, secret, time.Now())
+	if !ok {
+		return 0, errors.New("invalid code")
+	}
+	return step, nil
+}
+
+// validateTOTP checks the code against the steps around now, allowing for a
+// clock off by one step, and returns the step it matched
+func validateTOTP(code, secret string, now time.Time) (int64, bool) {
+	if secret == "" {
+		return 0, false
+	}
+
+	period := uint(30)
+	for _, skew := range []int64{0, -1, 1} {
+		t := now.Add(time.Duration(skew) * time.Duration(period) * time.Second)
+		ok, err := totp.ValidateCustom(code, secret, t, totp.ValidateOpts{
+			Period:    period,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && ok {
+			return t.Unix() / int64(period), true
+		}
+	}
+	return 0, false
+}
+
+// qrCode renders the key as a png data url that can be put in an img tag
+func qrCode(key *otp.Key) (template.URL, error) {
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// generateRecoveryCodes returns n random codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, nil
+}
+
+func (app *Config) adminTwoFactorRequired(ctx context.Context) bool {
+	value, err := app.Models.Setting.Get(ctx, data.SettingRequireAdminTwoFactor)
+	if err != nil {
+		//fail closed, an unreadable setting should not switch the check off
+		app.logError(ctx, err)
+		return true
+	}
+	return value == "true"
+}
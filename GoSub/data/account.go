@@ -0,0 +1,138 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ScheduleDeletion marks the account to be deleted once at has passed
+func (u *User) ScheduleDeletion(ctx context.Context, at time.Time) (err error) {
+	ctx, end := startQuery(ctx, "User.ScheduleDeletion")
+	defer end(&err)
+
+	stmt := `update users set delete_after = $1, updated_at = $2 where id = $3`
+
+	_, err = db.ExecContext(ctx, stmt, at, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	u.DeleteAfter = &at
+	return nil
+}
+
+// CancelDeletion keeps an account that was scheduled for deletion
+func (u *User) CancelDeletion(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.CancelDeletion")
+	defer end(&err)
+
+	stmt := `update users set delete_after = null, updated_at = $1 where id = $2`
+
+	_, err = db.ExecContext(ctx, stmt, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	u.DeleteAfter = nil
+	return nil
+}
+
+// GetDueForDeletion returns the users whose cooling-off period ended before now
+func (u *User) GetDueForDeletion(ctx context.Context, now time.Time) (_ []*User, err error) {
+	ctx, end := startQuery(ctx, "User.GetDueForDeletion")
+	defer end(&err)
+
+	query := `select id, email, first_name, last_name, delete_after
+		from users where delete_after is not null and delete_after <= $1 order by delete_after`
+
+	rows, err := db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.DeleteAfter,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, nil
+}
+
+// DeleteAccount deletes the user for good. Unlike Delete, the billing records are
+// kept for the books: invoices and subscription history are detached from the
+// user and stripped of the name and email. The audit events of the user are
+// pseudonymised: they keep the ids and the actions, without the personal data.
+func (u *User) DeleteAccount(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.DeleteAccount")
+	defer end(&err)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update invoices set user_id = null, billing_name = $1, billing_email = '' where user_id = $2`
+	_, err = tx.ExecContext(ctx, stmt, fmt.Sprintf("Deleted user #%d", u.ID), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update subscription_history set user_id = null where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_plans where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from users where id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	//the audit log keeps what happened, but not the addresses, devices and
+	//emails of the user. The trigger lets this update through for this
+	//transaction only.
+	_, err = tx.ExecContext(ctx, `select set_config('gosub.audit_pseudonymise', 'on', true)`)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update audit_events set ip = '', user_agent = '', payload = '{"pseudonymised": true}'
+		where actor_id = $1 or target_id = $1
+			or lower(payload->>'email') = lower($2)
+			or lower(payload->>'old_email') = lower($2)
+			or lower(payload->>'new_email') = lower($2)`
+	_, err = tx.ExecContext(ctx, stmt, u.ID, u.Email)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	//the email is personal data, so it is left out of the audit log this time
+	recordDeletion(ctx, u.ID, "")
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// GetUnreminded returns the accounts that were created before the given time, were
+// never activated, and have not been sent a reminder yet
+func (u *User) GetUnreminded(ctx context.Context, createdBefore time.Time) (_ []*User, err error) {
+	ctx, end := startQuery(ctx, "User.GetUnreminded")
+	defer end(&err)
+
+	query := `select id, email, first_name, last_name, created_at
+		from users
+		where activated_at is null and user_active = 0 and activation_reminded_at is null and created_at <= $1
+		order by created_at`
+
+	return queryInactiveUsers(ctx, query, createdBefore)
+}
+
+// GetExpiredInactive returns the accounts that were created before the given time
+// and were never activated. Accounts an admin deactivated are not among them.
+func (u *User) GetExpiredInactive(ctx context.Context, createdBefore time.Time) (_ []*User, err error) {
+	ctx, end := startQuery(ctx, "User.GetExpiredInactive")
+	defer end(&err)
+
+	query := `select id, email, first_name, last_name, created_at
+		from users
+		where activated_at is null and user_active = 0 and created_at <= $1
+		order by created_at`
+
+	return queryInactiveUsers(ctx, query, createdBefore)
+}
+
+func queryInactiveUsers(ctx context.Context, query string, createdBefore time.Time) ([]*User, error) {
+	rows, err := db.QueryContext(ctx, query, createdBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.CreatedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, nil
+}
+
+// MarkActivationReminded records that the activation reminder has been sent
+func (u *User) MarkActivationReminded(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.MarkActivationReminded")
+	defer end(&err)
+
+	stmt := `update users set activation_reminded_at = $1 where id = $2`
+
+	_, err = db.ExecContext(ctx, stmt, time.Now(), u.ID)
+	return err
+}
+
+// Activate activates the account, and records when it was first activated
+func (u *User) Activate(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.Activate")
+	defer end(&err)
+
+	stmt := `update users set user_active = 1, activated_at = coalesce(activated_at, $1), updated_at = $1 where id = $2`
+
+	_, err = db.ExecContext(ctx, stmt, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	u.Active = 1
+	return nil
+}
+
+// NeverActivated returns true if the account is waiting for its first activation,
+// as opposed to one that was deactivated
+func (u *User) NeverActivated(ctx context.Context) (_ bool, err error) {
+	ctx, end := startQuery(ctx, "User.NeverActivated")
+	defer end(&err)
+
+	var pending bool
+	query := `select activated_at is null and user_active = 0 from users where id = $1`
+	err = db.QueryRowContext(ctx, query, u.ID).Scan(&pending)
+	if err != nil {
+		return false, err
+	}
+
+	return pending, nil
+}
@@ -0,0 +1,250 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// actions recorded in the audit log
+const (
+	AuditImpersonationStart = "impersonation.start"
+	AuditImpersonationStop  = "impersonation.stop"
+	AuditLogin              = "user.login"
+	AuditLoginFailed        = "user.login_failed"
+	AuditActivated          = "user.activated"
+	AuditLocked             = "user.locked"
+	AuditUnlocked           = "user.unlocked"
+	AuditPasswordReset      = "user.password_reset"
+	AuditPasswordChanged    = "user.password_changed"
+	AuditProfileUpdated     = "user.profile_updated"
+	AuditSessionsRevoked    = "user.sessions_revoked"
+	AuditEmailChangeRequest = "user.email_change_requested"
+	AuditEmailChanged       = "user.email_changed"
+	AuditTwoFactorEnabled   = "user.2fa_enabled"
+	AuditTwoFactorDisabled  = "user.2fa_disabled"
+	AuditTwoFactorFailed    = "user.2fa_failed"
+	AuditSettingChanged     = "setting.changed"
+	AuditDeleted            = "user.deleted"
+	AuditDataExported       = "user.data_exported"
+	AuditDeletionScheduled  = "user.deletion_scheduled"
+	AuditDeletionCancelled  = "user.deletion_cancelled"
+	AuditPlanChanged        = "plan.changed"
+)
+
+// AuditActions lists every action, in the order they are offered in the viewer
+var AuditActions = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditActivated,
+	AuditLocked,
+	AuditUnlocked,
+	AuditPasswordReset,
+	AuditPasswordChanged,
+	AuditProfileUpdated,
+	AuditSessionsRevoked,
+	AuditEmailChangeRequest,
+	AuditEmailChanged,
+	AuditTwoFactorEnabled,
+	AuditTwoFactorDisabled,
+	AuditTwoFactorFailed,
+	AuditDataExported,
+	AuditDeletionScheduled,
+	AuditDeletionCancelled,
+	AuditDeleted,
+	AuditPlanChanged,
+	AuditImpersonationStart,
+	AuditImpersonationStop,
+	AuditSettingChanged,
+}
+
+// auditLimit is the most events the viewer loads at once
+const auditLimit = 200
+
+// AuditEvent is the type for one entry in the audit_events table
+type AuditEvent struct {
+	ID          int
+	ActorID     int
+	ActorEmail  string
+	Action      string
+	TargetID    int
+	TargetEmail string
+	IP          string
+	UserAgent   string
+	Payload     map[string]any
+	CreatedAt   time.Time
+}
+
+// AuditFilter narrows down the events returned by GetAll. Zero values are ignored.
+type AuditFilter struct {
+	Action   string
+	ActorID  int
+	TargetID int
+	From     time.Time
+	To       time.Time
+}
+
+// PayloadJSON returns the payload formatted for display
+func (a *AuditEvent) PayloadJSON() string {
+	if len(a.Payload) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(a.Payload)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// GetAll returns the newest events matching the filter
+func (a *AuditEvent) GetAll(ctx context.Context, filter AuditFilter) (_ []*AuditEvent, err error) {
+	ctx, end := startQuery(ctx, "AuditEvent.GetAll")
+	defer end(&err)
+
+	var where []string
+	var args []any
+
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		where = append(where, fmt.Sprintf("ae.action = $%d", len(args)))
+	}
+	if filter.ActorID != 0 {
+		args = append(args, filter.ActorID)
+		where = append(where, fmt.Sprintf("ae.actor_id = $%d", len(args)))
+	}
+	if filter.TargetID != 0 {
+		args = append(args, filter.TargetID)
+		where = append(where, fmt.Sprintf("ae.target_id = $%d", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		where = append(where, fmt.Sprintf("ae.created_at >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		where = append(where, fmt.Sprintf("ae.created_at < $%d", len(args)))
+	}
+
+	query := `select ae.id, coalesce(ae.actor_id, 0), coalesce(actor.email, ''), ae.action,
+		coalesce(ae.target_id, 0), coalesce(target.email, ''), ae.ip, ae.user_agent, ae.payload, ae.created_at
+		from audit_events ae
+		left join users actor on (actor.id = ae.actor_id)
+		left join users target on (target.id = ae.target_id)`
+
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	query += fmt.Sprintf(" order by ae.created_at desc, ae.id desc limit %d", auditLimit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEvents(ctx, rows)
+}
+
+// GetForUser returns every event the user took part in, as actor or as target,
+// oldest first
+func (a *AuditEvent) GetForUser(ctx context.Context, userID int) (_ []*AuditEvent, err error) {
+	ctx, end := startQuery(ctx, "AuditEvent.GetForUser")
+	defer end(&err)
+
+	query := `select ae.id, coalesce(ae.actor_id, 0), coalesce(actor.email, ''), ae.action,
+		coalesce(ae.target_id, 0), coalesce(target.email, ''), ae.ip, ae.user_agent, ae.payload, ae.created_at
+		from audit_events ae
+		left join users actor on (actor.id = ae.actor_id)
+		left join users target on (target.id = ae.target_id)
+		where ae.actor_id = $1 or ae.target_id = $1
+		order by ae.created_at, ae.id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuditEvents(ctx, rows)
+}
+
+func scanAuditEvents(ctx context.Context, rows *sql.Rows) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+
+	for rows.Next() {
+		var event AuditEvent
+		var payload []byte
+		err := rows.Scan(
+			&event.ID,
+			&event.ActorID,
+			&event.ActorEmail,
+			&event.Action,
+			&event.TargetID,
+			&event.TargetEmail,
+			&event.IP,
+			&event.UserAgent,
+			&payload,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		if err = json.Unmarshal(payload, &event.Payload); err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
+
+// Insert appends one event to the audit log, and returns the ID of the newly inserted row
+func (a *AuditEvent) Insert(ctx context.Context, event AuditEvent) (_ int, err error) {
+	ctx, end := startQuery(ctx, "AuditEvent.Insert")
+	defer end(&err)
+
+	return insertAuditEvent(ctx, event)
+}
+
+func insertAuditEvent(ctx context.Context, event AuditEvent) (int, error) {
+	if event.Payload == nil {
+		event.Payload = make(map[string]any)
+	}
+
+	payload, err := json.Marshal(event.Payload)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `insert into audit_events (actor_id, action, target_id, ip, user_agent, payload, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = db.QueryRowContext(ctx, stmt,
+		nullInt(event.ActorID),
+		event.Action,
+		nullInt(event.TargetID),
+		event.IP,
+		event.UserAgent,
+		string(payload),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// nullInt stores a zero id as NULL, so events without an actor or a target
+// are not pointing at a user that does not exist
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
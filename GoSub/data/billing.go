@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Invoice is the type for one entry in the invoices table. Invoices are billing
+// records, so they outlive the user: on deletion they are anonymised, not removed.
+type Invoice struct {
+	ID           int
+	UserID       int
+	PlanID       int
+	PlanName     string
+	Amount       int
+	BillingName  string
+	BillingEmail string
+	CreatedAt    time.Time
+}
+
+// AmountForDisplay formats the amount as a currency string
+func (i *Invoice) AmountForDisplay() string {
+	return fmt.Sprintf("$%.2f", float64(i.Amount)/100.0)
+}
+
+// Insert records an invoice, and returns the ID of the newly inserted row
+func (i *Invoice) Insert(ctx context.Context, invoice Invoice) (_ int, err error) {
+	ctx, end := startQuery(ctx, "Invoice.Insert")
+	defer end(&err)
+
+	var newID int
+	stmt := `insert into invoices (user_id, plan_id, plan_name, amount, billing_name, billing_email, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err = db.QueryRowContext(ctx, stmt,
+		invoice.UserID,
+		invoice.PlanID,
+		invoice.PlanName,
+		invoice.Amount,
+		invoice.BillingName,
+		invoice.BillingEmail,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetOne returns one invoice by id
+func (i *Invoice) GetOne(ctx context.Context, id int) (_ *Invoice, err error) {
+	ctx, end := startQuery(ctx, "Invoice.GetOne")
+	defer end(&err)
+
+	query := `select id, coalesce(user_id, 0), plan_id, plan_name, amount, billing_name, billing_email, created_at
+		from invoices where id = $1`
+
+	var invoice Invoice
+	row := db.QueryRowContext(ctx, query, id)
+
+	err = row.Scan(
+		&invoice.ID,
+		&invoice.UserID,
+		&invoice.PlanID,
+		&invoice.PlanName,
+		&invoice.Amount,
+		&invoice.BillingName,
+		&invoice.BillingEmail,
+		&invoice.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &invoice, nil
+}
+
+// GetAllForUser returns the invoices of a user, oldest first
+func (i *Invoice) GetAllForUser(ctx context.Context, userID int) (_ []*Invoice, err error) {
+	ctx, end := startQuery(ctx, "Invoice.GetAllForUser")
+	defer end(&err)
+
+	query := `select id, user_id, plan_id, plan_name, amount, billing_name, billing_email, created_at
+		from invoices where user_id = $1 order by created_at, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		var invoice Invoice
+		err := rows.Scan(
+			&invoice.ID,
+			&invoice.UserID,
+			&invoice.PlanID,
+			&invoice.PlanName,
+			&invoice.Amount,
+			&invoice.BillingName,
+			&invoice.BillingEmail,
+			&invoice.CreatedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		invoices = append(invoices, &invoice)
+	}
+
+	return invoices, nil
+}
+
+// SubscriptionRecord is one entry in the subscription history of a user. EndedAt
+// is nil for the subscription that is still running.
+type SubscriptionRecord struct {
+	ID         int
+	UserID     int
+	PlanID     int
+	PlanName   string
+	PlanAmount int
+	StartedAt  time.Time
+	EndedAt    *time.Time
+}
+
+// GetHistory returns every subscription the user has had, oldest first
+func (s *SubscriptionRecord) GetHistory(ctx context.Context, userID int) (_ []*SubscriptionRecord, err error) {
+	ctx, end := startQuery(ctx, "SubscriptionRecord.GetHistory")
+	defer end(&err)
+
+	query := `select id, user_id, plan_id, plan_name, plan_amount, started_at, ended_at
+		from subscription_history where user_id = $1 order by started_at, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*SubscriptionRecord
+
+	for rows.Next() {
+		var record SubscriptionRecord
+		err := rows.Scan(
+			&record.ID,
+			&record.UserID,
+			&record.PlanID,
+			&record.PlanName,
+			&record.PlanAmount,
+			&record.StartedAt,
+			&record.EndedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		records = append(records, &record)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,315 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// JobStatuses lists every status, in the order they are offered in the viewer
+var JobStatuses = []string{JobQueued, JobRunning, JobDone, JobFailed}
+
+// ErrDuplicateJob is returned by Enqueue when a job of the same type and unique key
+// is already queued or running
+var ErrDuplicateJob = errors.New("data: job already queued")
+
+// ErrJobLost is returned by the methods of a running job once it has been requeued
+// or claimed again, because its worker stopped sending heartbeats for too long
+var ErrJobLost = errors.New("data: job is no longer claimed by this worker")
+
+// jobLimit is the most jobs the viewer loads at once
+const jobLimit = 200
+
+// Job is the type for one entry in the jobs table
+type Job struct {
+	ID          int64
+	Type        string
+	Payload     json.RawMessage
+	Status      string
+	UniqueKey   string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	RunAt       time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+	//the trace context of the enqueuer, in the form of the trace propagators
+	TraceContext map[string]string
+}
+
+// Decode unmarshals the payload of the job into v
+func (j *Job) Decode(v any) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Enqueue inserts a queued job, and returns the ID of the newly inserted row
+func (j *Job) Enqueue(ctx context.Context, job Job) (_ int64, err error) {
+	ctx, end := startQuery(ctx, "Job.Enqueue")
+	defer end(&err)
+
+	if job.Payload == nil {
+		job.Payload = json.RawMessage("{}")
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	if job.TraceContext == nil {
+		job.TraceContext = map[string]string{}
+	}
+
+	traceContext, err := json.Marshal(job.TraceContext)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int64
+	stmt := `insert into jobs (type, payload, unique_key, max_attempts, run_at, created_at, updated_at, trace_context)
+		values ($1, $2, $3, $4, $5, $6, $6, $7)
+		on conflict (type, unique_key) where unique_key is not null and status in ('queued', 'running')
+		do nothing
+		returning id`
+
+	err = db.QueryRowContext(ctx, stmt,
+		job.Type,
+		string(job.Payload),
+		sql.NullString{String: job.UniqueKey, Valid: job.UniqueKey != ""},
+		job.MaxAttempts,
+		job.RunAt,
+		time.Now(),
+		string(traceContext),
+	).Scan(&newID)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrDuplicateJob
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Claim marks the oldest due job of the type as running and returns it. Rows locked
+// by other workers are skipped, so every job is claimed once. It returns
+// sql.ErrNoRows if there is nothing to do, which is not traced: the idle workers
+// poll every second.
+func (j *Job) Claim(ctx context.Context, jobType string) (_ *Job, err error) {
+	ctx, end := startPoll(ctx, "Job.Claim")
+	defer end(&err)
+
+	query := `update jobs set status = 'running', attempts = attempts + 1, updated_at = $2
+		where id = (
+			select id from jobs
+			where type = $1 and status = 'queued' and run_at <= $2
+			order by run_at, id
+			for update skip locked
+			limit 1
+		)
+		returning id, type, payload, status, coalesce(unique_key, ''), attempts, max_attempts,
+			last_error, run_at, created_at, updated_at, finished_at, trace_context`
+
+	row := db.QueryRowContext(ctx, query, jobType, time.Now())
+
+	return scanJob(row)
+}
+
+// Heartbeat tells the job is still running, so RequeueStale leaves it be. The
+// attempt count is the claim of the worker: a job that was claimed again since
+// returns ErrJobLost.
+func (j *Job) Heartbeat(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "Job.Heartbeat")
+	defer end(&err)
+
+	stmt := `update jobs set updated_at = $1 where id = $2 and status = 'running' and attempts = $3`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), j.ID, j.Attempts)
+	return claimed(result, err)
+}
+
+// Complete marks the job as done
+func (j *Job) Complete(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "Job.Complete")
+	defer end(&err)
+
+	stmt := `update jobs set status = 'done', last_error = '', updated_at = $1, finished_at = $1
+		where id = $2 and status = 'running' and attempts = $3`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), j.ID, j.Attempts)
+	return claimed(result, err)
+}
+
+// Fail records the error of the last attempt. The job is queued again to run at
+// retryAt, unless it has used all of its attempts; then it is marked as failed.
+func (j *Job) Fail(ctx context.Context, cause error, retryAt time.Time) (err error) {
+	ctx, end := startQuery(ctx, "Job.Fail")
+	defer end(&err)
+
+	now := time.Now()
+
+	if j.Attempts >= j.MaxAttempts {
+		stmt := `update jobs set status = 'failed', last_error = $1, updated_at = $2, finished_at = $2
+			where id = $3 and status = 'running' and attempts = $4`
+		result, err := db.ExecContext(ctx, stmt, cause.Error(), now, j.ID, j.Attempts)
+		return claimed(result, err)
+	}
+
+	stmt := `update jobs set status = 'queued', last_error = $1, run_at = $2, updated_at = $3
+		where id = $4 and status = 'running' and attempts = $5`
+	result, err := db.ExecContext(ctx, stmt, cause.Error(), retryAt, now, j.ID, j.Attempts)
+	return claimed(result, err)
+}
+
+// claimed turns an update of a running job that matched no row into ErrJobLost
+func claimed(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobLost
+	}
+
+	return nil
+}
+
+// RequeueStale puts back the running jobs whose last heartbeat is from before the
+// given time. Their worker died with the process that ran it.
+func (j *Job) RequeueStale(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, end := startQuery(ctx, "Job.RequeueStale")
+	defer end(&err)
+
+	stmt := `update jobs set status = 'queued', last_error = 'interrupted', updated_at = $1
+		where status = 'running' and updated_at < $2`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// PurgeFinished deletes the jobs that are done or failed since before the given time
+func (j *Job) PurgeFinished(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, end := startQuery(ctx, "Job.PurgeFinished")
+	defer end(&err)
+
+	stmt := `delete from jobs where status in ('done', 'failed') and finished_at < $1`
+
+	result, err := db.ExecContext(ctx, stmt, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Retry queues a failed job again, with a fresh set of attempts
+func (j *Job) Retry(ctx context.Context, id int64) (err error) {
+	ctx, end := startQuery(ctx, "Job.Retry")
+	defer end(&err)
+
+	now := time.Now()
+	stmt := `update jobs set status = 'queued', attempts = 0, run_at = $1, updated_at = $1, finished_at = null
+		where id = $2 and status = 'failed'`
+
+	result, err := db.ExecContext(ctx, stmt, now, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetAll returns the newest jobs, of one status or of every status if it is empty
+func (j *Job) GetAll(ctx context.Context, status string) (_ []*Job, err error) {
+	ctx, end := startQuery(ctx, "Job.GetAll")
+	defer end(&err)
+
+	query := `select id, type, payload, status, coalesce(unique_key, ''), attempts, max_attempts,
+		last_error, run_at, created_at, updated_at, finished_at, trace_context
+		from jobs`
+
+	var args []any
+	if status != "" {
+		args = append(args, status)
+		query += " where status = $1"
+	}
+	query += fmt.Sprintf(" order by created_at desc, id desc limit %d", jobLimit)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// scanJob reads one job from a *sql.Row or *sql.Rows
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var job Job
+	var payload, traceContext []byte
+
+	err := row.Scan(
+		&job.ID,
+		&job.Type,
+		&payload,
+		&job.Status,
+		&job.UniqueKey,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.LastError,
+		&job.RunAt,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.FinishedAt,
+		&traceContext,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = payload
+	if err = json.Unmarshal(traceContext, &job.TraceContext); err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
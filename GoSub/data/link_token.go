@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// link purposes
+const (
+	LinkUnlock        = "unlock"
+	LinkPasswordReset = "password_reset"
+	LinkEmailChange   = "email_change"
+)
+
+// LinkToken is the server side of a link mailed to a user, like the one that
+// unlocks an account. The link carries a random token; the table only keeps its
+// hash, with the data the link acts on, so a link can not be made up from what is
+// known about the user, and works once.
+type LinkToken struct {
+	UserID    int
+	Purpose   string
+	Payload   map[string]string
+	ExpiresAt time.Time
+}
+
+// Issue stores a new token of the purpose for the user, in place of the ones
+// issued before, and returns it to be put in the link
+func (t *LinkToken) Issue(ctx context.Context, userID int, purpose string, payload map[string]string, ttl time.Duration) (_ string, err error) {
+	ctx, end := startQuery(ctx, "LinkToken.Issue")
+	defer end(&err)
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if payload == nil {
+		payload = map[string]string{}
+	}
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	stmt := `with replaced as (delete from link_tokens where user_id = $2 and purpose = $3)
+		insert into link_tokens (token_hash, user_id, purpose, payload, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	_, err = db.ExecContext(ctx, stmt, hashLinkToken(token), userID, purpose, string(p), now.Add(ttl), now)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Use deletes the token and returns it, if it is of the purpose and has not
+// expired. It returns sql.ErrNoRows otherwise.
+func (t *LinkToken) Use(ctx context.Context, purpose, token string) (_ *LinkToken, err error) {
+	ctx, end := startQuery(ctx, "LinkToken.Use")
+	defer end(&err)
+
+	query := `delete from link_tokens
+		where token_hash = $1 and purpose = $2 and expires_at > $3
+		returning user_id, purpose, payload, expires_at`
+
+	return scanLinkToken(db.QueryRowContext(ctx, query, hashLinkToken(token), purpose, time.Now()))
+}
+
+// Find returns the token, if it is of the purpose and has not expired, without
+// using it up. It returns sql.ErrNoRows otherwise.
+func (t *LinkToken) Find(ctx context.Context, purpose, token string) (_ *LinkToken, err error) {
+	ctx, end := startQuery(ctx, "LinkToken.Find")
+	defer end(&err)
+
+	query := `select user_id, purpose, payload, expires_at from link_tokens
+		where token_hash = $1 and purpose = $2 and expires_at > $3`
+
+	return scanLinkToken(db.QueryRowContext(ctx, query, hashLinkToken(token), purpose, time.Now()))
+}
+
+// Revoke deletes the tokens of the purpose issued to the user
+func (t *LinkToken) Revoke(ctx context.Context, userID int, purpose string) (err error) {
+	ctx, end := startQuery(ctx, "LinkToken.Revoke")
+	defer end(&err)
+
+	stmt := `delete from link_tokens where user_id = $1 and purpose = $2`
+
+	_, err = db.ExecContext(ctx, stmt, userID, purpose)
+	return err
+}
+
+func scanLinkToken(row interface{ Scan(...any) error }) (*LinkToken, error) {
+	var t LinkToken
+	var payload []byte
+
+	if err := row.Scan(&t.UserID, &t.Purpose, &payload, &t.ExpiresAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &t.Payload); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func hashLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
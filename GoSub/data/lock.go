@@ -0,0 +1,60 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+)
+
+// AdvisoryLock is a Postgres advisory lock. It belongs to the database session, so
+// it is held on a connection taken out of the pool until it is released.
+type AdvisoryLock struct {
+	conn *sql.Conn
+	key  int64
+}
+
+// TryAdvisoryLock takes the lock with the given name without waiting for it. It
+// returns nil and false if another session, in this process or another, holds it.
+func TryAdvisoryLock(ctx context.Context, name string) (_ *AdvisoryLock, _ bool, err error) {
+	ctx, end := startQuery(ctx, "TryAdvisoryLock")
+	defer end(&err)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := advisoryLockKey(name)
+
+	var ok bool
+	err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, key).Scan(&ok)
+	if err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+
+	return &AdvisoryLock{conn: conn, key: key}, true, nil
+}
+
+// Release gives the lock back and returns the connection to the pool
+func (l *AdvisoryLock) Release() (err error) {
+	ctx, end := startQuery(context.Background(), "AdvisoryLock.Release")
+	defer end(&err)
+
+	_, err = l.conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, l.key)
+	if err != nil {
+		// the lock may still be held, so the connection must not be reused
+		_ = l.conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+
+	l.conn.Close()
+	return err
+}
+
+// advisoryLockKey turns a lock name into the bigint key Postgres expects
+func advisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
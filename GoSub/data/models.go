@@ -1,22 +1,110 @@
 package data
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"gosub/validation"
+	"log/slog"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const dbTimeout = time.Second * 3
 
 var db *sql.DB
 
+// passwordPolicy is checked before any password is hashed
+var passwordPolicy = validation.DefaultPasswordPolicy()
+
+// SetPasswordPolicy replaces the policy that Insert and ResetPassword enforce
+func SetPasswordPolicy(policy *validation.PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// logger is where the package logs the errors it does not return. Records are
+// logged with the context of the call, so they carry the fields of the request.
+var logger = slog.Default()
+
+// SetLogger replaces the logger of the package
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// tracer starts a span for every query, under the span of the request or job
+// that runs it
+var tracer = otel.Tracer("gosub/data")
+
+// startQuery starts the span of a query, named after the method that runs it,
+// and bounds the query with dbTimeout. The returned func ends both, and marks
+// the span failed with the error the method returns. It is deferred with a
+// pointer to the named error result, so it sees the error once it is returned.
+func startQuery(ctx context.Context, name string) (context.Context, func(errp *error)) {
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	)
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+
+	return ctx, func(errp *error) {
+		cancel()
+		endSpan(span, *errp)
+	}
+}
+
+// startPoll is startQuery for a query run in a loop, like the claim of a job. Most
+// runs find nothing, so the span is only recorded for the ones that return a row
+// or fail, from the time the query started.
+func startPoll(ctx context.Context, name string) (context.Context, func(errp *error)) {
+	start := time.Now()
+	queryCtx, cancel := context.WithTimeout(ctx, dbTimeout)
+
+	return queryCtx, func(errp *error) {
+		cancel()
+		if errors.Is(*errp, sql.ErrNoRows) {
+			return
+		}
+
+		_, span := tracer.Start(ctx, name,
+			trace.WithTimestamp(start),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemPostgreSQL),
+		)
+		endSpan(span, *errp)
+	}
+}
+
+// endSpan records err on the span, if any, and ends it. A query finding no row
+// did not fail, the caller decides what that means.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 // New is the function used to create an instance of the data package. It returns the type
 // Model, which embeds all the types we want to be available to our application.
 func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: User{},
-		Plan: Plan{},
+		User:                    User{},
+		Plan:                    Plan{},
+		AuditEvent:              AuditEvent{},
+		Setting:                 Setting{},
+		NotificationPreferences: NotificationPreferences{},
+		UserSession:             UserSession{},
+		Invoice:                 Invoice{},
+		SubscriptionRecord:      SubscriptionRecord{},
+		Job:                     Job{},
+		RenewalNotice:           RenewalNotice{},
+		LinkToken:               LinkToken{},
 	}
 }
 
@@ -24,6 +112,15 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User User
-	Plan Plan
+	User                    User
+	Plan                    Plan
+	AuditEvent              AuditEvent
+	Setting                 Setting
+	NotificationPreferences NotificationPreferences
+	UserSession             UserSession
+	Invoice                 Invoice
+	SubscriptionRecord      SubscriptionRecord
+	Job                     Job
+	RenewalNotice           RenewalNotice
+	LinkToken               LinkToken
 }
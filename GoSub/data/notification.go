@@ -0,0 +1,71 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// NotificationPreferences holds which optional emails a user wants to get.
+// Security and billing emails are always sent.
+type NotificationPreferences struct {
+	UserID           int
+	LoginAlerts      bool
+	RenewalReminders bool
+	UpdatedAt        time.Time
+}
+
+// DefaultNotificationPreferences returns the preferences of a user who never saved any
+func DefaultNotificationPreferences(userID int) *NotificationPreferences {
+	return &NotificationPreferences{
+		UserID:           userID,
+		LoginAlerts:      false,
+		RenewalReminders: true,
+	}
+}
+
+// Get returns the preferences of one user, or the defaults if none were saved
+func (n *NotificationPreferences) Get(ctx context.Context, userID int) (_ *NotificationPreferences, err error) {
+	ctx, end := startQuery(ctx, "NotificationPreferences.Get")
+	defer end(&err)
+
+	query := `select user_id, login_alerts, renewal_reminders, updated_at
+		from notification_preferences where user_id = $1`
+
+	var prefs NotificationPreferences
+	err = db.QueryRowContext(ctx, query, userID).Scan(
+		&prefs.UserID,
+		&prefs.LoginAlerts,
+		&prefs.RenewalReminders,
+		&prefs.UpdatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DefaultNotificationPreferences(userID), nil
+		}
+		return nil, err
+	}
+
+	return &prefs, nil
+}
+
+// Save inserts or updates the preferences stored in the receiver
+func (n *NotificationPreferences) Save(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "NotificationPreferences.Save")
+	defer end(&err)
+
+	stmt := `insert into notification_preferences (user_id, login_alerts, renewal_reminders, updated_at)
+		values ($1, $2, $3, $4)
+		on conflict (user_id) do update set
+			login_alerts = excluded.login_alerts,
+			renewal_reminders = excluded.renewal_reminders,
+			updated_at = excluded.updated_at`
+
+	_, err = db.ExecContext(ctx, stmt, n.UserID, n.LoginAlerts, n.RenewalReminders, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package data
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHasher is fast, the defaults take too long for every case
+func testHasher(algorithm string) PasswordHasher {
+	h := DefaultPasswordHasher()
+	h.Algorithm = algorithm
+	h.BcryptCost = bcrypt.MinCost
+	h.Argon2.Time = 1
+	h.Argon2.Memory = 1024
+	h.Argon2.Threads = 1
+	return h
+}
+
+func TestPasswordHasher_HashVerify(t *testing.T) {
+	for _, algorithm := range []string{HashBcrypt, HashArgon2id} {
+		t.Run(algorithm, func(t *testing.T) {
+			h := testHasher(algorithm)
+
+			hash, err := h.Hash("Correct-Horse7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if algorithm == HashArgon2id && !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+				t.Errorf("hash = %q", hash)
+			}
+
+			other, err := h.Hash("Correct-Horse7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == hash {
+				t.Error("two hashes of the same password are equal, the salt is not random")
+			}
+
+			tests := []struct {
+				password string
+				want     bool
+			}{
+				{"Correct-Horse7", true},
+				{"correct-horse7", false},
+				{"Correct-Horse", false},
+				{"", false},
+			}
+			for _, tt := range tests {
+				ok, err := h.Verify(hash, tt.password)
+				if err != nil {
+					t.Fatalf("Verify(%q) error = %v", tt.password, err)
+				}
+				if ok != tt.want {
+					t.Errorf("Verify(%q) = %v, want %v", tt.password, ok, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordHasher_VerifyAcrossAlgorithms(t *testing.T) {
+	bcryptHash, _ := testHasher(HashBcrypt).Hash("secret")
+	argonHash, _ := testHasher(HashArgon2id).Hash("secret")
+
+	//the configured algorithm does not matter, the hash says what it is
+	for _, h := range []PasswordHasher{testHasher(HashBcrypt), testHasher(HashArgon2id)} {
+		for _, hash := range []string{bcryptHash, argonHash} {
+			if ok, err := h.Verify(hash, "secret"); err != nil || !ok {
+				t.Errorf("%s Verify(%q) = %v, %v", h.Algorithm, hash, ok, err)
+			}
+		}
+	}
+}
+
+func TestPasswordHasher_VerifyMalformed(t *testing.T) {
+	h := testHasher(HashArgon2id)
+
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"plain text", "secret"},
+		{"truncated bcrypt", "$2a$04$abc"},
+		{"too few parts", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ"},
+		{"too many parts", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5$extra"},
+		{"wrong version", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"no version", "$argon2id$$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"bad params", "$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"params out of order", "$argon2id$v=19$t=1,m=1024,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"zero memory", "$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"zero time", "$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"zero threads", "$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5"},
+		{"threads overflow", "$argon2id$v=19$m=1024,t=1,p=300$c2FsdHNhbHQ$a2V5a2V5"},
+		{"negative memory", "$argon2id$v=19$m=-1,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5"},
+		{"bad salt", "$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5a2V5"},
+		{"padded salt", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA==$a2V5a2V5"},
+		{"empty salt", "$argon2id$v=19$m=1024,t=1,p=1$$a2V5a2V5"},
+		{"bad key", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$!!!"},
+		{"empty key", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, password := range []string{"", "secret"} {
+				ok, err := h.Verify(tt.hash, password)
+				if ok {
+					t.Fatalf("Verify(%q, %q) = true", tt.hash, password)
+				}
+				if err == nil {
+					t.Errorf("Verify(%q, %q) error = nil", tt.hash, password)
+				}
+			}
+
+			if strings.HasPrefix(tt.hash, "$argon2id$") {
+				if _, _, _, err := decodeArgon2(tt.hash); !errors.Is(err, errInvalidHash) {
+					t.Errorf("decodeArgon2() error = %v, want errInvalidHash", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeArgon2(t *testing.T) {
+	h := testHasher(HashArgon2id)
+	h.Argon2.KeyLen = 24
+	h.Argon2.SaltLen = 8
+
+	hash, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != h.Argon2 {
+		t.Errorf("params = %+v, want %+v", p, h.Argon2)
+	}
+	if len(salt) != 8 || len(key) != 24 {
+		t.Errorf("salt is %d bytes and key %d, want 8 and 24", len(salt), len(key))
+	}
+}
+
+func TestPasswordHasher_NeedsRehash(t *testing.T) {
+	weakBcrypt, _ := testHasher(HashBcrypt).Hash("secret")
+	weakArgon, _ := testHasher(HashArgon2id).Hash("secret")
+
+	strongBcrypt := testHasher(HashBcrypt)
+	strongBcrypt.BcryptCost = bcrypt.MinCost + 1
+
+	moreTime := testHasher(HashArgon2id)
+	moreTime.Argon2.Time = 2
+	moreMemory := testHasher(HashArgon2id)
+	moreMemory.Argon2.Memory = 2048
+	longerKey := testHasher(HashArgon2id)
+	longerKey.Argon2.KeyLen = 64
+	fewerThreads := testHasher(HashArgon2id)
+	fewerThreads.Argon2.Threads = 4
+
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{"bcrypt, same cost", testHasher(HashBcrypt), weakBcrypt, false},
+		{"bcrypt, higher cost", strongBcrypt, weakBcrypt, true},
+		{"bcrypt, lower cost", testHasher(HashBcrypt), mustHash(t, strongBcrypt), false},
+		{"bcrypt to argon2id", testHasher(HashArgon2id), weakBcrypt, true},
+		{"argon2id to bcrypt", testHasher(HashBcrypt), weakArgon, true},
+		{"argon2id, same params", testHasher(HashArgon2id), weakArgon, false},
+		{"argon2id, more time", moreTime, weakArgon, true},
+		{"argon2id, more memory", moreMemory, weakArgon, true},
+		{"argon2id, longer key", longerKey, weakArgon, true},
+		{"argon2id, threads only", fewerThreads, weakArgon, false},
+		{"malformed bcrypt", testHasher(HashBcrypt), "$2a$04$abc", true},
+		{"malformed argon2id", testHasher(HashArgon2id), "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5", true},
+		{"empty", testHasher(HashBcrypt), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash(%q) = %v, want %v", tt.hash, got, tt.want)
+			}
+		})
+	}
+}
+
+func mustHash(t *testing.T, h PasswordHasher) string {
+	t.Helper()
+
+	hash, err := h.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
@@ -3,7 +3,6 @@ package data
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 )
 
@@ -17,9 +16,9 @@ type Plan struct {
 	UpdatedAt           time.Time
 }
 
-func (p *Plan) GetAll() ([]*Plan, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (p *Plan) GetAll(ctx context.Context) (_ []*Plan, err error) {
+	ctx, end := startQuery(ctx, "Plan.GetAll")
+	defer end(&err)
 
 	query := `select id, plan_name, plan_amount, created_at, updated_at
 	from plans order by id`
@@ -44,7 +43,7 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 
 		plan.PlanAmountFormatted = plan.AmountForDisplay()
 		if err != nil {
-			log.Println("Error scanning", err)
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
 			return nil, err
 		}
 
@@ -55,16 +54,16 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 }
 
 // GetOne returns one plan by id
-func (p *Plan) GetOne(id int) (*Plan, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (p *Plan) GetOne(ctx context.Context, id int) (_ *Plan, err error) {
+	ctx, end := startQuery(ctx, "Plan.GetOne")
+	defer end(&err)
 
 	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
 
 	var plan Plan
 	row := db.QueryRowContext(ctx, query, id)
 
-	err := row.Scan(
+	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
@@ -82,14 +81,22 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 }
 
 // SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// values into user_plans table. The change is also kept in subscription_history.
+func (p *Plan) SubscribeUserToPlan(ctx context.Context, user User, plan Plan) (err error) {
+	ctx, end := startQuery(ctx, "Plan.SubscribeUserToPlan")
+	defer end(&err)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
 
 	// delete existing plan, if any
 	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
+	_, err = tx.ExecContext(ctx, stmt, user.ID)
 	if err != nil {
 		return err
 	}
@@ -98,11 +105,79 @@ func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
 	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
 			values ($1, $2, $3, $4)`
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
+	_, err = tx.ExecContext(ctx, stmt, user.ID, plan.ID, now, now)
+	if err != nil {
+		return err
+	}
+
+	// close the previous entry of the history and open a new one
+	stmt = `update subscription_history set ended_at = $2 where user_id = $1 and ended_at is null`
+	_, err = tx.ExecContext(ctx, stmt, user.ID, now)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	stmt = `insert into subscription_history (user_id, plan_id, plan_name, plan_amount, started_at)
+			values ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, stmt, user.ID, plan.ID, plan.PlanName, plan.PlanAmount, now)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Subscription is the plan a user is subscribed to, with the dates of the subscription
+type Subscription struct {
+	UserID    int
+	Plan      Plan
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GetSubscription returns the current subscription of a user. It returns
+// sql.ErrNoRows if the user has no plan.
+func (p *Plan) GetSubscription(ctx context.Context, userID int) (_ *Subscription, err error) {
+	ctx, end := startQuery(ctx, "Plan.GetSubscription")
+	defer end(&err)
+
+	query := `select up.user_id, p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at,
+			up.created_at, up.updated_at
+			from user_plans up
+			left join plans p on (p.id = up.plan_id)
+			where up.user_id = $1`
+
+	var sub Subscription
+	row := db.QueryRowContext(ctx, query, userID)
+
+	err = row.Scan(
+		&sub.UserID,
+		&sub.Plan.ID,
+		&sub.Plan.PlanName,
+		&sub.Plan.PlanAmount,
+		&sub.Plan.CreatedAt,
+		&sub.Plan.UpdatedAt,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sub.Plan.PlanAmountFormatted = sub.Plan.AmountForDisplay()
+
+	return &sub, nil
+}
+
+// NextRenewal returns the next monthly anniversary of the subscription after now
+func (s *Subscription) NextRenewal() time.Time {
+	now := time.Now()
+	next := s.CreatedAt
+	for months := 1; !next.After(now); months++ {
+		next = s.CreatedAt.AddDate(0, months, 0)
+	}
+	return next
 }
 
 // AmountForDisplay formats the price we have in the DB as a currency string
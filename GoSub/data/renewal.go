@@ -0,0 +1,100 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// RenewalNotice is the subscription of a user who wants to be reminded before it renews
+type RenewalNotice struct {
+	Subscription
+	Email     string
+	FirstName string
+}
+
+// GetAll returns the subscriptions of active users who have not turned renewal
+// reminders off. Users who never saved their preferences get the default.
+func (n *RenewalNotice) GetAll(ctx context.Context) (_ []*RenewalNotice, err error) {
+	ctx, end := startQuery(ctx, "RenewalNotice.GetAll")
+	defer end(&err)
+
+	query := `select up.user_id, u.email, u.first_name, p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at,
+			up.created_at, up.updated_at
+			from user_plans up
+			join users u on (u.id = up.user_id)
+			join plans p on (p.id = up.plan_id)
+			left join notification_preferences np on (np.user_id = up.user_id)
+			where u.user_active = 1 and coalesce(np.renewal_reminders, $1)
+			order by up.user_id`
+
+	rows, err := db.QueryContext(ctx, query, DefaultNotificationPreferences(0).RenewalReminders)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notices []*RenewalNotice
+
+	for rows.Next() {
+		var notice RenewalNotice
+		err := rows.Scan(
+			&notice.UserID,
+			&notice.Email,
+			&notice.FirstName,
+			&notice.Plan.ID,
+			&notice.Plan.PlanName,
+			&notice.Plan.PlanAmount,
+			&notice.Plan.CreatedAt,
+			&notice.Plan.UpdatedAt,
+			&notice.CreatedAt,
+			&notice.UpdatedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		notice.Plan.PlanAmountFormatted = notice.Plan.AmountForDisplay()
+		notices = append(notices, &notice)
+	}
+
+	return notices, nil
+}
+
+// MarkSent records the reminder for one renewal. It returns false if it had been
+// recorded already, so every renewal is reminded once.
+func (n *RenewalNotice) MarkSent(ctx context.Context, renewal time.Time) (_ bool, err error) {
+	ctx, end := startQuery(ctx, "RenewalNotice.MarkSent")
+	defer end(&err)
+
+	stmt := `insert into renewal_reminders (user_id, renewal_date, sent_at) values ($1, $2, $3)
+		on conflict do nothing`
+
+	result, err := db.ExecContext(ctx, stmt, n.UserID, renewal.Format("2006-01-02"), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rows == 1, nil
+}
+
+// PurgeBefore deletes the records of the reminders for renewals before the given
+// time. A renewal that has passed is not reminded again, so they are not needed.
+func (n *RenewalNotice) PurgeBefore(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, end := startQuery(ctx, "RenewalNotice.PurgeBefore")
+	defer end(&err)
+
+	stmt := `delete from renewal_reminders where renewal_date < $1`
+
+	result, err := db.ExecContext(ctx, stmt, before.Format("2006-01-02"))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
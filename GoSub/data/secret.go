@@ -0,0 +1,80 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// sealedPrefix marks a value encrypted by sealSecret. Values without it were
+// stored before secrets were encrypted.
+const sealedPrefix = "enc:"
+
+var errInvalidSecret = errors.New("data: invalid encrypted secret")
+
+// secretCipher encrypts the secrets stored in the database, like the TOTP secrets
+var secretCipher cipher.AEAD
+
+// SetSecretKey sets the server key the stored secrets are encrypted with. The
+// key can be any length, the AES-256 key is derived from it.
+func SetSecretKey(key []byte) error {
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	secretCipher = aead
+	return nil
+}
+
+// sealSecret encrypts a secret to be stored
+func sealSecret(plain string) (string, error) {
+	if secretCipher == nil {
+		return "", errors.New("data: no secret key set")
+	}
+
+	nonce := make([]byte, secretCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := secretCipher.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a stored secret. A secret stored before encryption is
+// returned as it is, with legacy set.
+func openSecret(stored string) (plain string, legacy bool, err error) {
+	if stored == "" {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, true, nil
+	}
+	if secretCipher == nil {
+		return "", false, errors.New("data: no secret key set")
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil || len(sealed) < secretCipher.NonceSize() {
+		return "", false, errInvalidSecret
+	}
+
+	nonce, ciphertext := sealed[:secretCipher.NonceSize()], sealed[secretCipher.NonceSize():]
+	b, err := secretCipher.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", false, errInvalidSecret
+	}
+
+	return string(b), false, nil
+}
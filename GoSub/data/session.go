@@ -0,0 +1,152 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// UserSession is one login of a user, as stored in the user_sessions table. The
+// session data itself lives in redis; this row is what the user sees and revokes.
+type UserSession struct {
+	ID         string
+	UserID     int
+	Device     string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	RevokedAt  *time.Time
+}
+
+// Insert records a new login
+func (s *UserSession) Insert(ctx context.Context, session UserSession) (err error) {
+	ctx, end := startQuery(ctx, "UserSession.Insert")
+	defer end(&err)
+
+	stmt := `insert into user_sessions (id, user_id, device, ip, created_at, last_seen_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	_, err = db.ExecContext(ctx, stmt,
+		session.ID,
+		session.UserID,
+		session.Device,
+		session.IP,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetActive returns the sessions of a user that are not revoked and were
+// started after since, newest first
+func (s *UserSession) GetActive(ctx context.Context, userID int, since time.Time) (_ []*UserSession, err error) {
+	ctx, end := startQuery(ctx, "UserSession.GetActive")
+	defer end(&err)
+
+	query := `select id, user_id, device, ip, created_at, last_seen_at, revoked_at
+		from user_sessions
+		where user_id = $1 and revoked_at is null and created_at > $2
+		order by last_seen_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*UserSession
+
+	for rows.Next() {
+		var session UserSession
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.Device,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.RevokedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
+// Touch updates the last time a session was used
+func (s *UserSession) Touch(ctx context.Context, id string) (err error) {
+	ctx, end := startQuery(ctx, "UserSession.Touch")
+	defer end(&err)
+
+	stmt := `update user_sessions set last_seen_at = $1 where id = $2`
+	_, err = db.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Revoke marks one session of a user as revoked, and returns the ids that were revoked
+func (s *UserSession) Revoke(ctx context.Context, userID int, id string) ([]string, error) {
+	return revokeSessions(ctx, `update user_sessions set revoked_at = $1
+		where user_id = $2 and id = $3 and revoked_at is null returning id`, userID, id)
+}
+
+// RevokeOthers revokes every session of a user except the one to keep, and
+// returns the ids that were revoked
+func (s *UserSession) RevokeOthers(ctx context.Context, userID int, keepID string) ([]string, error) {
+	return revokeSessions(ctx, `update user_sessions set revoked_at = $1
+		where user_id = $2 and id <> $3 and revoked_at is null returning id`, userID, keepID)
+}
+
+// RevokeAll revokes every session of a user, and returns the ids that were revoked
+func (s *UserSession) RevokeAll(ctx context.Context, userID int) ([]string, error) {
+	return revokeSessions(ctx, `update user_sessions set revoked_at = $1
+		where user_id = $2 and revoked_at is null returning id`, userID)
+}
+
+func revokeSessions(ctx context.Context, stmt string, args ...any) (_ []string, err error) {
+	ctx, end := startQuery(ctx, "revokeSessions")
+	defer end(&err)
+
+	rows, err := db.QueryContext(ctx, stmt, append([]any{time.Now()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// PurgeBefore deletes the sessions that ended, or were last seen, before the given time
+func (s *UserSession) PurgeBefore(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, end := startQuery(ctx, "UserSession.PurgeBefore")
+	defer end(&err)
+
+	stmt := `delete from user_sessions where coalesce(revoked_at, last_seen_at) < $1`
+
+	result, err := db.ExecContext(ctx, stmt, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
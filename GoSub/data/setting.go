@@ -0,0 +1,54 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// site wide settings that admins can change
+const (
+	SettingRequireAdminTwoFactor = "require_admin_2fa"
+)
+
+// Setting is the type for one key/value pair in the settings table
+type Setting struct {
+	Key       string
+	Value     string
+	UpdatedAt time.Time
+}
+
+// Get returns the value of a setting, or an empty string if it was never set
+func (s *Setting) Get(ctx context.Context, key string) (_ string, err error) {
+	ctx, end := startQuery(ctx, "Setting.Get")
+	defer end(&err)
+
+	var value string
+	query := `select value from settings where key = $1`
+	err = db.QueryRowContext(ctx, query, key).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return value, nil
+}
+
+// Set inserts or updates the value of a setting
+func (s *Setting) Set(ctx context.Context, key, value string) (err error) {
+	ctx, end := startQuery(ctx, "Setting.Set")
+	defer end(&err)
+
+	stmt := `insert into settings (key, value, updated_at) values ($1, $2, $3)
+		on conflict (key) do update set value = excluded.value, updated_at = excluded.updated_at`
+
+	_, err = db.ExecContext(ctx, stmt, key, value, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
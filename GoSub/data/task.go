@@ -0,0 +1,30 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// ClaimTaskRun records that the task runs for the given slot of its schedule. It
+// returns false if this slot, or a later one, was run already, by this instance
+// or another one whose clock fired a little earlier or later.
+func ClaimTaskRun(ctx context.Context, name string, slot time.Time) (_ bool, err error) {
+	ctx, end := startQuery(ctx, "ClaimTaskRun")
+	defer end(&err)
+
+	stmt := `insert into scheduled_tasks (name, last_run_at) values ($1, $2)
+		on conflict (name) do update set last_run_at = excluded.last_run_at
+		where scheduled_tasks.last_run_at < excluded.last_run_at`
+
+	result, err := db.ExecContext(ctx, stmt, name, slot)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// GetTOTPSecret returns the TOTP secret of the user, decrypted. It is kept out
+// of the other user queries so it never ends up in the session. A secret stored
+// before secrets were encrypted is encrypted on the way.
+func (u *User) GetTOTPSecret(ctx context.Context) (_ string, err error) {
+	ctx, end := startQuery(ctx, "User.GetTOTPSecret")
+	defer end(&err)
+
+	var stored string
+	query := `select totp_secret from users where id = $1`
+	err = db.QueryRowContext(ctx, query, u.ID).Scan(&stored)
+	if err != nil {
+		return "", err
+	}
+
+	secret, legacy, err := openSecret(stored)
+	if err != nil {
+		return "", err
+	}
+
+	if legacy {
+		sealed, err := sealSecret(secret)
+		if err == nil {
+			stmt := `update users set totp_secret = $1 where id = $2 and totp_secret = $3`
+			_, err = db.ExecContext(ctx, stmt, sealed, u.ID, stored)
+		}
+		if err != nil {
+			logger.ErrorContext(ctx, "Encrypting TOTP secret failed", "user_id", u.ID, "err", err)
+		}
+	}
+
+	return secret, nil
+}
+
+// UseTOTPStep records the time step of a TOTP code the user logged in with. It
+// returns false if a code of that step or a later one was used before, so an
+// observed code cannot be replayed.
+func (u *User) UseTOTPStep(ctx context.Context, step int64) (_ bool, err error) {
+	ctx, end := startQuery(ctx, "User.UseTOTPStep")
+	defer end(&err)
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+	result, err := db.ExecContext(ctx, stmt, step, u.ID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// EnableTwoFactor stores the TOTP secret of the user, encrypted, and replaces the
+// recovery codes with the given ones. step is the time step of the code that
+// confirmed the enrollment, which cannot be used again to log in.
+func (u *User) EnableTwoFactor(ctx context.Context, secret string, step int64, recoveryCodes []string) (err error) {
+	ctx, end := startQuery(ctx, "User.EnableTwoFactor")
+	defer end(&err)
+
+	sealed, err := sealSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_secret = $1, totp_last_step = $2, totp_enabled = 1, updated_at = $3 where id = $4`
+	_, err = tx.ExecContext(ctx, stmt, sealed, step, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `insert into user_recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, stmt, u.ID, hashRecoveryCode(code), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DisableTwoFactor removes the TOTP secret and the recovery codes of the user
+func (u *User) DisableTwoFactor(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.DisableTwoFactor")
+	defer end(&err)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_secret = '', totp_last_step = 0, totp_enabled = 0, updated_at = $1 where id = $2`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of the user as used. It returns
+// false if the code does not exist or was used before.
+func (u *User) UseRecoveryCode(ctx context.Context, code string) (_ bool, err error) {
+	ctx, end := startQuery(ctx, "User.UseRecoveryCode")
+	defer end(&err)
+
+	stmt := `update user_recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), u.ID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// RemainingRecoveryCodes returns how many recovery codes the user has left
+func (u *User) RemainingRecoveryCodes(ctx context.Context) (_ int, err error) {
+	ctx, end := startQuery(ctx, "User.RemainingRecoveryCodes")
+	defer end(&err)
+
+	var count int
+	query := `select count(*) from user_recovery_codes where user_id = $1 and used_at is null`
+	err = db.QueryRowContext(ctx, query, u.ID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// hashRecoveryCode normalises a recovery code, so dashes and case do not matter, and hashes it.
+// The codes are random, so a plain sha256 is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
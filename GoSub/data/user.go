@@ -3,29 +3,90 @@ package data
 import (
 	"context"
 	"errors"
-	"golang.org/x/crypto/bcrypt"
-	"log"
+	"github.com/jackc/pgconn"
 	"time"
 )
 
+// ErrDuplicateEmail is returned by Insert and Update when the email is already registered
+var ErrDuplicateEmail = errors.New("data: duplicate email")
+
 // User is the structure which holds one user from the database.
 type User struct {
-	ID        int
-	Email     string
-	FirstName string
-	LastName  string
-	Password  string
-	Active    int
-	IsAdmin   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Plan      *Plan
+	ID               int
+	Email            string
+	FirstName        string
+	LastName         string
+	Password         string
+	Active           int
+	IsAdmin          int
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	Plan             *Plan
+	TwoFactorEnabled int
+	DeleteAfter      *time.Time
 }
 
 // GetAll returns a slice of all users, sorted by last name
-func (u *User) GetAll() ([]*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) GetAll(ctx context.Context) (_ []*User, err error) {
+	ctx, end := startQuery(ctx, "User.GetAll")
+	defer end(&err)
+
+	query := `
+	select 
+    	id, 
+       	email, 
+       	first_name, 
+       	last_name, 
+       	password, 
+       	user_active, 
+       	is_admin, 
+       	totp_enabled, 
+       	delete_after, 
+       	created_at, 
+       	updated_at
+	from 
+	    users 
+	order by 
+	    last_name`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.Active,
+			&user.IsAdmin,
+			&user.TwoFactorEnabled,
+			&user.DeleteAfter,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, nil
+}
+
+// GetAdmins returns the active admins, sorted by last name
+func (u *User) GetAdmins(ctx context.Context) (_ []*User, err error) {
+	ctx, end := startQuery(ctx, "User.GetAdmins")
+	defer end(&err)
 
 	query := `
 	select 
@@ -36,10 +97,14 @@ func (u *User) GetAll() ([]*User, error) {
        	password, 
        	user_active, 
        	is_admin, 
+       	totp_enabled, 
+       	delete_after, 
        	created_at, 
        	updated_at
 	from 
 	    users 
+	where 
+	    is_admin = 1 and user_active = 1
 	order by 
 	    last_name`
 
@@ -61,11 +126,13 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.Password,
 			&user.Active,
 			&user.IsAdmin,
+			&user.TwoFactorEnabled,
+			&user.DeleteAfter,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
 		if err != nil {
-			log.Println("Error scanning", err)
+			logger.ErrorContext(ctx, "Error scanning", "err", err)
 			return nil, err
 		}
 
@@ -76,9 +143,9 @@ func (u *User) GetAll() ([]*User, error) {
 }
 
 // GetByEmail returns one user by email
-func (u *User) GetByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) GetByEmail(ctx context.Context, email string) (_ *User, err error) {
+	ctx, end := startQuery(ctx, "User.GetByEmail")
+	defer end(&err)
 
 	query := `
 			select 
@@ -89,6 +156,8 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    password, 
 			    user_active, 
 			    is_admin, 
+			    totp_enabled, 
+			    delete_after, 
 			    created_at, 
 			    updated_at 
 			from 
@@ -99,7 +168,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	var user User
 	row := db.QueryRowContext(ctx, query, email)
 
-	err := row.Scan(
+	err = row.Scan(
 		&user.ID,
 		&user.Email,
 		&user.FirstName,
@@ -107,6 +176,8 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.TwoFactorEnabled,
+		&user.DeleteAfter,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -140,18 +211,18 @@ func (u *User) GetByEmail(email string) (*User, error) {
 }
 
 // GetOne returns one user by id
-func (u *User) GetOne(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) GetOne(ctx context.Context, id int) (_ *User, err error) {
+	ctx, end := startQuery(ctx, "User.GetOne")
+	defer end(&err)
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at 
+	query := `select id, email, first_name, last_name, password, user_active, is_admin, totp_enabled, delete_after, created_at, updated_at 
 				from users 
 				where id = $1`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, id)
 
-	err := row.Scan(
+	err = row.Scan(
 		&user.ID,
 		&user.Email,
 		&user.FirstName,
@@ -159,6 +230,8 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.TwoFactorEnabled,
+		&user.DeleteAfter,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -187,7 +260,7 @@ func (u *User) GetOne(id int) (*User, error) {
 	if err == nil {
 		user.Plan = &plan
 	} else {
-		log.Println("Error getting plan", err)
+		logger.ErrorContext(ctx, "Error getting plan", "err", err)
 	}
 
 	return &user, nil
@@ -195,9 +268,9 @@ func (u *User) GetOne(id int) (*User, error) {
 
 // Update updates one user in the database, using the information
 // stored in the receiver u
-func (u *User) Update() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) Update(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.Update")
+	defer end(&err)
 
 	stmt := `update users set
 		email = $1,
@@ -207,7 +280,7 @@ func (u *User) Update() error {
 		updated_at = $5
 		where id = $6`
 
-	_, err := db.ExecContext(ctx, stmt,
+	_, err = db.ExecContext(ctx, stmt,
 		u.Email,
 		u.FirstName,
 		u.LastName,
@@ -217,6 +290,10 @@ func (u *User) Update() error {
 	)
 
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrDuplicateEmail
+		}
 		return err
 	}
 
@@ -224,48 +301,75 @@ func (u *User) Update() error {
 }
 
 // Delete deletes one user from the database, by User.ID
-func (u *User) Delete() error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) Delete(ctx context.Context) (err error) {
+	ctx, end := startQuery(ctx, "User.Delete")
+	defer end(&err)
 
 	stmt := `delete from users where id = $1`
 
-	_, err := db.ExecContext(ctx, stmt, u.ID)
+	_, err = db.ExecContext(ctx, stmt, u.ID)
 	if err != nil {
 		return err
 	}
 
+	recordDeletion(ctx, u.ID, u.Email)
+
 	return nil
 }
 
 // DeleteByID deletes one user from the database, by ID
-func (u *User) DeleteByID(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) DeleteByID(ctx context.Context, id int) (err error) {
+	ctx, end := startQuery(ctx, "User.DeleteByID")
+	defer end(&err)
 
 	stmt := `delete from users where id = $1`
 
-	_, err := db.ExecContext(ctx, stmt, id)
+	_, err = db.ExecContext(ctx, stmt, id)
 	if err != nil {
 		return err
 	}
 
+	recordDeletion(ctx, id, "")
+
 	return nil
 }
 
+// recordDeletion writes the deletion of a user to the audit log. The user is already
+// gone at this point, so a failure is only logged.
+func recordDeletion(ctx context.Context, id int, email string) {
+	payload := make(map[string]any)
+	if email != "" {
+		payload["email"] = email
+	}
+
+	_, err := insertAuditEvent(ctx, AuditEvent{
+		Action:   AuditDeleted,
+		TargetID: id,
+		Payload:  payload,
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "Error recording deletion", "err", err)
+	}
+}
+
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
-func (u *User) Insert(user User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+func (u *User) Insert(ctx context.Context, user User) (_ int, err error) {
+	ctx, end := startQuery(ctx, "User.Insert")
+	defer end(&err)
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	err = passwordPolicy.Check(user.Password, user.Email)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := passwordHasher.Hash(user.Password)
 	if err != nil {
 		return 0, err
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, user_active, activated_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, case when $5 = 1 then $6::timestamp end, $6, $7) returning id`
 
 	err = db.QueryRowContext(ctx, stmt,
 		user.Email,
@@ -278,18 +382,28 @@ func (u *User) Insert(user User) (int, error) {
 	).Scan(&newID)
 
 	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return 0, ErrDuplicateEmail
+		}
 		return 0, err
 	}
 
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (u *User) ResetPassword(password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
+// ResetPassword is the method we will use to change a user's password. The receiver
+// needs the Email of the user, so the policy can reject passwords containing it.
+func (u *User) ResetPassword(ctx context.Context, password string) (err error) {
+	ctx, end := startQuery(ctx, "User.ResetPassword")
+	defer end(&err)
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	err = passwordPolicy.Check(password, u.Email)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := passwordHasher.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -300,23 +414,49 @@ func (u *User) ResetPassword(password string) error {
 		return err
 	}
 
+	u.Password = hashedPassword
+
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
-func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
+// PasswordMatches compares a user supplied password with the hash we have stored
+// for a given user in the database. If the password and hash match, we return true;
+// otherwise, we return false. A matching hash that is older or weaker than the
+// configured one is upgraded in place, since this is the only time we see the password.
+func (u *User) PasswordMatches(ctx context.Context, plainText string) (bool, error) {
+	match, err := passwordHasher.Verify(u.Password, plainText)
+	if err != nil || !match {
+		return false, err
+	}
+
+	if passwordHasher.NeedsRehash(u.Password) {
+		if err := u.upgradePasswordHash(ctx, plainText); err != nil {
+			logger.ErrorContext(ctx, "Error upgrading password hash", "err", err)
 		}
 	}
 
 	return true, nil
 }
+
+// upgradePasswordHash stores a new hash of an already verified password. Unlike
+// ResetPassword it skips the policy, so users with older passwords can still log in.
+func (u *User) upgradePasswordHash(ctx context.Context, plainText string) (err error) {
+	ctx, end := startQuery(ctx, "User.upgradePasswordHash")
+	defer end(&err)
+
+	hashedPassword, err := passwordHasher.Hash(plainText)
+	if err != nil {
+		return err
+	}
+
+	// only replace the hash we verified against, in case it changed meanwhile
+	stmt := `update users set password = $1 where id = $2 and password = $3`
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID, u.Password)
+	if err != nil {
+		return err
+	}
+
+	u.Password = hashedPassword
+
+	return nil
+}
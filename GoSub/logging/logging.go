@@ -0,0 +1,133 @@
+// Package logging sets up the structured logger of the app. Fields added to a
+// context with With, like the id and route of a request, are attached to every
+// record logged with that context, in the handlers as well as in the packages
+// they call.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fieldsKey is the context key of the fields
+type fieldsKey struct{}
+
+// New returns a logger writing to w in format, "json" or "text", that drops the
+// records below level
+func New(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     level,
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("logging: unknown format %s", format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+// ParseLevel reads a level like "debug", "info", "warn" or "error"
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+// With returns a copy of ctx that carries the fields, as key and value pairs or
+// slog.Attr values, on top of the ones ctx carries already
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := Fields(ctx)
+	r := slog.Record{}
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	return context.WithValue(ctx, fieldsKey{}, attrs)
+}
+
+// Fields returns the fields ctx carries
+func Fields(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(fieldsKey{}).([]slog.Attr)
+	//a copy, so appending never writes into the slice of another context
+	return append([]slog.Attr(nil), attrs...)
+}
+
+// Detach returns a copy of ctx with its lazy fields worked out now, for work that
+// outlives the request, like a queued mail or an error reported later. A lazy
+// field may read the state of the request, which is recycled once it is served.
+func Detach(ctx context.Context) context.Context {
+	if ctx == nil {
+		return nil
+	}
+
+	attrs := Fields(ctx)
+	resolved := attrs[:0]
+	for _, attr := range attrs {
+		if attr.Value.Kind() == slog.KindLogValuer {
+			attr.Value = attr.Value.Resolve()
+			if attr.Value.Kind() == slog.KindGroup && len(attr.Value.Group()) == 0 {
+				//unknown, like the user of a request without one
+				continue
+			}
+		}
+		resolved = append(resolved, attr)
+	}
+
+	return context.WithValue(ctx, fieldsKey{}, resolved)
+}
+
+// contextHandler adds the fields and the span of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := Fields(ctx)
+	//the span the record was logged in, so logs and traces can be matched up
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		attrs = append(attrs,
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+
+	if len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Lazy is a field whose value is worked out when a record is logged, like the
+// user of a request, who may only be known after the request has logged in
+type Lazy func() slog.Value
+
+// LogValue implements slog.LogValuer
+func (f Lazy) LogValue() slog.Value {
+	return f()
+}
@@ -0,0 +1,10 @@
+create table if not exists audit_events
+(
+    id         serial primary key,
+    actor_id   integer,
+    action     varchar(255) not null,
+    target_id  integer,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists audit_events_created_at_idx on audit_events (created_at);
@@ -0,0 +1,20 @@
+alter table users add column if not exists totp_secret varchar(64) not null default '';
+alter table users add column if not exists totp_enabled integer not null default 0;
+
+create table if not exists user_recovery_codes
+(
+    id         serial primary key,
+    user_id    integer not null references users (id) on delete cascade,
+    code_hash  varchar(64) not null,
+    used_at    timestamp without time zone,
+    created_at timestamp without time zone not null default now()
+);
+
+create index if not exists user_recovery_codes_user_id_idx on user_recovery_codes (user_id);
+
+create table if not exists settings
+(
+    key        varchar(255) primary key,
+    value      text not null default '',
+    updated_at timestamp without time zone not null default now()
+);
@@ -0,0 +1,2 @@
+-- argon2id hashes are longer than the 60 characters of a bcrypt hash
+alter table users alter column password type varchar(255);
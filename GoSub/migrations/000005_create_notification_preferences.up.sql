@@ -0,0 +1,7 @@
+create table if not exists notification_preferences
+(
+    user_id           integer primary key references users (id) on delete cascade,
+    login_alerts      boolean not null default false,
+    renewal_reminders boolean not null default true,
+    updated_at        timestamp without time zone not null default now()
+);
@@ -0,0 +1,12 @@
+create table if not exists user_sessions
+(
+    id           varchar(64) primary key,
+    user_id      integer not null references users (id) on delete cascade,
+    device       text not null default '',
+    ip           varchar(64) not null default '',
+    created_at   timestamp without time zone not null default now(),
+    last_seen_at timestamp without time zone not null default now(),
+    revoked_at   timestamp without time zone
+);
+
+create index if not exists user_sessions_user_id_idx on user_sessions (user_id);
@@ -0,0 +1,28 @@
+alter table users add column if not exists delete_after timestamp without time zone;
+
+create table if not exists subscription_history
+(
+    id          serial primary key,
+    user_id     integer references users (id) on delete set null,
+    plan_id     integer not null,
+    plan_name   varchar(255) not null,
+    plan_amount integer not null,
+    started_at  timestamp without time zone not null default now(),
+    ended_at    timestamp without time zone
+);
+
+create index if not exists subscription_history_user_id_idx on subscription_history (user_id);
+
+create table if not exists invoices
+(
+    id            serial primary key,
+    user_id       integer references users (id) on delete set null,
+    plan_id       integer not null,
+    plan_name     varchar(255) not null,
+    amount        integer not null,
+    billing_name  varchar(255) not null default '',
+    billing_email varchar(255) not null default '',
+    created_at    timestamp without time zone not null default now()
+);
+
+create index if not exists invoices_user_id_idx on invoices (user_id);
@@ -0,0 +1,3 @@
+alter table users add column if not exists activation_reminded_at timestamp without time zone;
+
+create index if not exists users_inactive_created_at_idx on users (created_at) where user_active = 0;
@@ -0,0 +1,24 @@
+create table if not exists jobs
+(
+    id           bigserial primary key,
+    type         varchar(100) not null,
+    payload      jsonb not null default '{}',
+    status       varchar(20) not null default 'queued',
+    unique_key   varchar(255),
+    attempts     integer not null default 0,
+    max_attempts integer not null default 5,
+    last_error   text not null default '',
+    run_at       timestamp without time zone not null default now(),
+    created_at   timestamp without time zone not null default now(),
+    updated_at   timestamp without time zone not null default now(),
+    finished_at  timestamp without time zone
+);
+
+-- workers claim the oldest due job of their type
+create index if not exists jobs_ready_idx on jobs (type, run_at) where status = 'queued';
+
+-- a unique key can only be queued or running once at a time
+create unique index if not exists jobs_unique_key_idx on jobs (type, unique_key)
+    where unique_key is not null and status in ('queued', 'running');
+
+create index if not exists jobs_created_at_idx on jobs (created_at);
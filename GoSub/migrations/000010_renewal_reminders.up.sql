@@ -0,0 +1,7 @@
+create table if not exists renewal_reminders
+(
+    user_id      integer not null references users (id) on delete cascade,
+    renewal_date date not null,
+    sent_at      timestamp without time zone not null default now(),
+    primary key (user_id, renewal_date)
+);
@@ -0,0 +1,2 @@
+-- the trace context of the request that enqueued the job, so the job joins its trace
+alter table jobs add column if not exists trace_context jsonb not null default '{}';
@@ -0,0 +1,4 @@
+-- encrypted secrets are longer than the base32 ones
+alter table users alter column totp_secret type text;
+-- the time step of the last TOTP code accepted, so a code cannot be replayed
+alter table users add column if not exists totp_last_step bigint not null default 0;
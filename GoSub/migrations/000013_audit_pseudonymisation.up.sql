@@ -0,0 +1,23 @@
+-- the audit log stays append-only, with one exception: when an account is
+-- deleted, the personal data in its rows is erased. The transaction deleting it
+-- asks for that with the gosub.audit_pseudonymise setting, and only the ip, the
+-- user agent and the payload can be blanked.
+create or replace function audit_events_append_only() returns trigger as
+$$
+begin
+    if tg_op = 'UPDATE'
+        and current_setting('gosub.audit_pseudonymise', true) = 'on'
+        and new.id = old.id
+        and new.action = old.action
+        and new.actor_id is not distinct from old.actor_id
+        and new.target_id is not distinct from old.target_id
+        and new.created_at = old.created_at
+        and new.ip = ''
+        and new.user_agent = ''
+        and new.payload = '{"pseudonymised": true}'::jsonb then
+        return new;
+    end if;
+
+    raise exception 'audit_events is append-only';
+end;
+$$ language plpgsql;
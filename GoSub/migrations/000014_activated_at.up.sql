@@ -0,0 +1,21 @@
+-- when the account was first activated. Deactivating an account later does not
+-- clear it, so only the accounts that were never activated are reminded and
+-- purged. The accounts from before this column cannot be told apart, so none
+-- of them is taken for one that was never activated. The backfill only runs with
+-- the column being added, so running the file again leaves pending accounts be.
+do
+$$
+begin
+    if not exists (select 1
+                   from information_schema.columns
+                   where table_schema = current_schema()
+                     and table_name = 'users'
+                     and column_name = 'activated_at') then
+        alter table users add column activated_at timestamp without time zone;
+        update users set activated_at = created_at;
+    end if;
+end;
+$$;
+
+drop index if exists users_inactive_created_at_idx;
+create index if not exists users_never_activated_created_at_idx on users (created_at) where activated_at is null;
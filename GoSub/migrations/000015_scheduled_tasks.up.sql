@@ -0,0 +1,6 @@
+-- the schedule slot each task last ran for, so a slot runs once across instances
+create table if not exists scheduled_tasks
+(
+    name        varchar(255) primary key,
+    last_run_at timestamp without time zone not null
+);
@@ -0,0 +1,12 @@
+-- the single-use tokens of the links mailed to users; only their hash is stored
+create table if not exists link_tokens
+(
+    token_hash varchar(64) primary key,
+    user_id    integer                     not null references users (id) on delete cascade,
+    purpose    varchar(32)                 not null,
+    payload    jsonb                       not null default '{}',
+    expires_at timestamp without time zone not null,
+    created_at timestamp without time zone not null
+);
+
+create index if not exists link_tokens_user_id_purpose_idx on link_tokens (user_id, purpose);
@@ -0,0 +1,418 @@
+// Package reporting collects the errors of the app. Every error is reported with
+// its stack and the fields of its context, like the route, the user or the job.
+// Errors are grouped by fingerprint for a digest, and the ones that repeat too
+// often are only counted instead of being logged and sent to the sinks again.
+package reporting
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gosub/logging"
+	"log/slog"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otherFingerprint groups the errors that come in once MaxGroups is reached
+const otherFingerprint = "other"
+
+// Report is one error, as it is sent to the sinks
+type Report struct {
+	Fingerprint string            `json:"fingerprint"`
+	Message     string            `json:"message"`
+	Stack       string            `json:"stack,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+// Sink is an external service the reports are sent to, like an error tracker or
+// a chat webhook
+type Sink interface {
+	Send(ctx context.Context, report Report) error
+}
+
+// Group is the errors of one fingerprint since the last digest
+type Group struct {
+	Fingerprint string
+	Message     string            //of the first error
+	Stack       string            //of the first error
+	Fields      map[string]string //of the last error
+	Count       int
+	Suppressed  int //not logged or sent, because of the rate limit
+	First       time.Time
+	Last        time.Time
+}
+
+// Options configure a Reporter. The zero value of a field picks its default.
+type Options struct {
+	Sinks []Sink
+	//how many errors of one fingerprint are let through per Window, 5 by default
+	Burst int
+	//1 minute by default
+	Window time.Duration
+	//how many fingerprints are kept apart until the next digest, 500 by default
+	MaxGroups int
+	//how long a sink gets to take a report, 10 seconds by default
+	SinkTimeout time.Duration
+	//called when a sink fails, it must not report the error again
+	OnSinkError func(err error)
+}
+
+// window counts the errors of a fingerprint let through since start
+type window struct {
+	start time.Time
+	count int
+}
+
+// Reporter groups and rate limits errors, and sends the ones let through to the
+// sinks in the background
+type Reporter struct {
+	opts    Options
+	mu      sync.Mutex
+	groups  map[string]*Group
+	windows map[string]*window
+	queue   chan Report
+	closed  bool
+	done    chan struct{}
+}
+
+// New returns a reporter, and starts sending reports to the sinks
+func New(opts Options) *Reporter {
+	if opts.Burst <= 0 {
+		opts.Burst = 5
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if opts.MaxGroups <= 0 {
+		opts.MaxGroups = 500
+	}
+	if opts.SinkTimeout <= 0 {
+		opts.SinkTimeout = 10 * time.Second
+	}
+
+	r := &Reporter{
+		opts:    opts,
+		groups:  make(map[string]*Group),
+		windows: make(map[string]*window),
+		queue:   make(chan Report, 100),
+		done:    make(chan struct{}),
+	}
+	go r.send()
+
+	return r
+}
+
+// Capture reports err with the fields of ctx. The stack is the one Wrap or
+// Recovered attached to err, or else the stack of the caller, skip frames above
+// the one calling Capture. It returns false if err was rate limited, and should
+// not be logged either.
+func (r *Reporter) Capture(ctx context.Context, err error, skip int) bool {
+	if err == nil {
+		return false
+	}
+
+	var stack []uintptr
+	var w *wrapped
+	if errors.As(err, &w) {
+		stack = w.stack
+		if ctx == nil {
+			ctx = w.ctx
+		}
+	} else {
+		stack = callers(skip + 3)
+	}
+
+	report := Report{
+		Message: err.Error(),
+		Stack:   formatStack(stack),
+		Fields:  fields(ctx),
+		Time:    time.Now(),
+	}
+	report.Fingerprint = fingerprint(report.Message, stack)
+
+	return r.record(report)
+}
+
+// record adds the report to its group and, when it is within the rate limit,
+// queues it for the sinks
+func (r *Reporter) record(report Report) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := report.Fingerprint
+	if _, ok := r.groups[key]; !ok && len(r.groups) >= r.opts.MaxGroups {
+		key = otherFingerprint
+	}
+
+	g, ok := r.groups[key]
+	if !ok {
+		g = &Group{
+			Fingerprint: key,
+			Message:     report.Message,
+			Stack:       report.Stack,
+			First:       report.Time,
+		}
+		if key == otherFingerprint {
+			g.Message = "Other errors, too many kinds to keep apart"
+			g.Stack = ""
+		}
+		r.groups[key] = g
+	}
+	g.Count++
+	g.Last = report.Time
+	g.Fields = report.Fields
+
+	w, ok := r.windows[key]
+	if !ok || report.Time.Sub(w.start) >= r.opts.Window {
+		if len(r.windows) >= r.opts.MaxGroups {
+			r.pruneWindows(report.Time)
+		}
+		w = &window{start: report.Time}
+		r.windows[key] = w
+	}
+
+	if w.count >= r.opts.Burst {
+		g.Suppressed++
+		return false
+	}
+	w.count++
+
+	if len(r.opts.Sinks) > 0 && !r.closed {
+		select {
+		case r.queue <- report:
+		default:
+			//the sinks are behind, the error is still in the digest
+		}
+	}
+
+	return true
+}
+
+// pruneWindows forgets the windows that are over
+func (r *Reporter) pruneWindows(now time.Time) {
+	for key, w := range r.windows {
+		if now.Sub(w.start) >= r.opts.Window {
+			delete(r.windows, key)
+		}
+	}
+}
+
+// Digest returns the groups since the last digest, the most frequent first, and
+// starts new ones
+func (r *Reporter) Digest() []Group {
+	r.mu.Lock()
+	groups := r.groups
+	r.groups = make(map[string]*Group)
+	r.mu.Unlock()
+
+	digest := make([]Group, 0, len(groups))
+	for _, g := range groups {
+		digest = append(digest, *g)
+	}
+	sort.Slice(digest, func(i, j int) bool {
+		if digest[i].Count != digest[j].Count {
+			return digest[i].Count > digest[j].Count
+		}
+		return digest[i].First.Before(digest[j].First)
+	})
+
+	return digest
+}
+
+// Restore puts back the groups of a digest that could not be sent, so they are in
+// the next one. They are merged with the groups reported since.
+func (r *Reporter) Restore(groups []Group) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, restored := range groups {
+		key := restored.Fingerprint
+		if _, ok := r.groups[key]; !ok && len(r.groups) >= r.opts.MaxGroups {
+			key = otherFingerprint
+		}
+
+		g, ok := r.groups[key]
+		if !ok {
+			g := restored
+			g.Fingerprint = key
+			if key == otherFingerprint && restored.Fingerprint != otherFingerprint {
+				g.Message = "Other errors, too many kinds to keep apart"
+				g.Stack = ""
+			}
+			r.groups[key] = &g
+			continue
+		}
+
+		//the restored errors came first
+		if key == restored.Fingerprint {
+			g.Message = restored.Message
+			g.Stack = restored.Stack
+		}
+		g.Count += restored.Count
+		g.Suppressed += restored.Suppressed
+		if restored.First.Before(g.First) {
+			g.First = restored.First
+		}
+		if restored.Last.After(g.Last) {
+			g.Last = restored.Last
+			g.Fields = restored.Fields
+		}
+	}
+}
+
+// Close stops sending reports to the sinks, once the queued ones are sent
+func (r *Reporter) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+
+	<-r.done
+}
+
+func (r *Reporter) send() {
+	defer close(r.done)
+
+	for report := range r.queue {
+		for _, sink := range r.opts.Sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), r.opts.SinkTimeout)
+			err := sink.Send(ctx, report)
+			cancel()
+			if err != nil && r.opts.OnSinkError != nil {
+				r.opts.OnSinkError(err)
+			}
+		}
+	}
+}
+
+// wrapped is an error with the context and the stack it was reported from
+type wrapped struct {
+	err   error
+	ctx   context.Context
+	stack []uintptr
+}
+
+func (w *wrapped) Error() string { return w.err.Error() }
+func (w *wrapped) Unwrap() error { return w.err }
+
+// Wrap attaches ctx and the stack of the caller to err, for an error that is
+// captured later and elsewhere, like on the other end of the error channel. A
+// stack err carries already is kept. The lazy fields of ctx are worked out now,
+// while the request they read is still being served.
+func Wrap(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	stack := callers(3)
+	var w *wrapped
+	if errors.As(err, &w) && len(w.stack) > 0 {
+		stack = w.stack
+	}
+
+	return &wrapped{err: err, ctx: logging.Detach(ctx), stack: stack}
+}
+
+// Recovered turns the value of a recovered panic into an error with the stack of
+// the panic. It is called from the deferred function that recovered.
+func Recovered(p any) error {
+	//from the panic on, without the deferred function
+	return &wrapped{err: fmt.Errorf("panic: %v", p), stack: callers(4)}
+}
+
+// ContextOf returns the context Wrap attached to err, or an empty one
+func ContextOf(err error) context.Context {
+	var w *wrapped
+	if errors.As(err, &w) && w.ctx != nil {
+		return w.ctx
+	}
+	return context.Background()
+}
+
+func callers(skip int) []uintptr {
+	pcs := make([]uintptr, 32)
+	return pcs[:runtime.Callers(skip, pcs)]
+}
+
+func formatStack(stack []uintptr) string {
+	var b strings.Builder
+
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" {
+			fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+
+	return b.String()
+}
+
+// variable parts of messages, like ids, counts and quoted values
+var variablePart = regexp.MustCompile(`"[^"]*"|'[^']*'|0x[0-9a-fA-F]+|\d+`)
+
+// fingerprint is the same for errors of the same kind from the same place: the
+// message without its variable parts, and the function it was reported from
+func fingerprint(message string, stack []uintptr) string {
+	h := sha256.New()
+	h.Write([]byte(variablePart.ReplaceAllString(message, "_")))
+
+	//the first frame outside of the runtime, which panics go through
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			h.Write([]byte{0})
+			h.Write([]byte(frame.Function))
+			break
+		}
+		if !more {
+			break
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// fields reads the logging fields and the trace of ctx
+func fields(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+
+	m := make(map[string]string)
+	for _, attr := range logging.Fields(ctx) {
+		v := attr.Value.Resolve()
+		if v.Kind() == slog.KindGroup && len(v.Group()) == 0 {
+			//an unknown lazy field, like the user of a request without one
+			continue
+		}
+		m[attr.Key] = v.String()
+	}
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		m["trace_id"] = sc.TraceID().String()
+	}
+
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
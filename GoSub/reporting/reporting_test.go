@@ -0,0 +1,265 @@
+package reporting
+
+import (
+	"context"
+	"errors"
+	"gosub/logging"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureFrom reports err like the listener of the error channel, from a function
+// of its own to tell call sites apart
+func captureFrom(r *Reporter, err error) bool {
+	return r.Capture(ContextOf(err), err, 0)
+}
+
+func otherCaptureFrom(r *Reporter, err error) bool {
+	return r.Capture(ContextOf(err), err, 0)
+}
+
+func TestFingerprint(t *testing.T) {
+	stack := callers(1)
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"same message", "connection refused", "connection refused", true},
+		{"ids", "job 12 attempt 1/5 failed", "job 9731 attempt 3/5 failed", true},
+		{"double quotes", `unknown job type "manual"`, `unknown job type "invoice_mail"`, true},
+		{"single quotes", "column 'email' is missing", "column 'plan_id' is missing", true},
+		{"addresses", "bad pointer 0xc000012345", "bad pointer 0xc0000abcde", true},
+		{"other words", "connection refused", "connection reset", false},
+		{"other shape", "job 12 failed", "job failed", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := fingerprint(tt.a, stack), fingerprint(tt.b, stack)
+			if (a == b) != tt.same {
+				t.Errorf("fingerprint(%q) = %s, fingerprint(%q) = %s, same = %v, want %v", tt.a, a, tt.b, b, a == b, tt.same)
+			}
+		})
+	}
+}
+
+func TestCapture_FingerprintCallSite(t *testing.T) {
+	r := New(Options{})
+	defer r.Close()
+
+	err := errors.New("connection refused")
+	captureFrom(r, err)
+	captureFrom(r, err)
+	otherCaptureFrom(r, err)
+
+	digest := r.Digest()
+	if len(digest) != 2 {
+		t.Fatalf("got %d groups, want 2", len(digest))
+	}
+	if digest[0].Count != 2 || digest[1].Count != 1 {
+		t.Errorf("counts = %d, %d, want 2, 1", digest[0].Count, digest[1].Count)
+	}
+	if !strings.Contains(digest[0].Stack, "captureFrom") {
+		t.Errorf("stack does not start at the caller:\n%s", digest[0].Stack)
+	}
+}
+
+func TestCapture_Wrapped(t *testing.T) {
+	r := New(Options{})
+	defer r.Close()
+
+	//wrapped in one place and captured in another, like over the error channel
+	ctx := logging.With(context.Background(), "job_type", "manual")
+	err := Wrap(ctx, errors.New("connection refused"))
+	captureFrom(r, err)
+	otherCaptureFrom(r, err)
+
+	digest := r.Digest()
+	if len(digest) != 1 {
+		t.Fatalf("got %d groups, want 1", len(digest))
+	}
+	g := digest[0]
+	if g.Count != 2 {
+		t.Errorf("count = %d, want 2", g.Count)
+	}
+	if !strings.Contains(g.Stack, "TestCapture_Wrapped") || strings.Contains(g.Stack, "captureFrom") {
+		t.Errorf("stack is not the one of Wrap:\n%s", g.Stack)
+	}
+	if g.Fields["job_type"] != "manual" {
+		t.Errorf("fields = %v, want the job type of the wrapped context", g.Fields)
+	}
+}
+
+func TestRecord_RateLimit(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		offsets        []time.Duration
+		wantLetThrough int
+		wantSuppressed int
+	}{
+		{"within the burst", []time.Duration{0, 1, 2}, 3, 0},
+		{"burst used up", []time.Duration{0, 1, 2, 3, 4, 5}, 3, 3},
+		{"window over", []time.Duration{0, 1, 2, 3, time.Minute, time.Minute + 1}, 5, 1},
+		{"window counts from its first error", []time.Duration{0, 30 * time.Second, 30 * time.Second, 59 * time.Second, 61 * time.Second}, 4, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(Options{Burst: 3, Window: time.Minute})
+			defer r.Close()
+
+			letThrough := 0
+			for _, offset := range tt.offsets {
+				if r.record(Report{Fingerprint: "f", Message: "boom", Time: start.Add(offset)}) {
+					letThrough++
+				}
+			}
+
+			if letThrough != tt.wantLetThrough {
+				t.Errorf("let through %d, want %d", letThrough, tt.wantLetThrough)
+			}
+
+			digest := r.Digest()
+			if len(digest) != 1 {
+				t.Fatalf("got %d groups, want 1", len(digest))
+			}
+			if digest[0].Count != len(tt.offsets) {
+				t.Errorf("count = %d, want %d", digest[0].Count, len(tt.offsets))
+			}
+			if digest[0].Suppressed != tt.wantSuppressed {
+				t.Errorf("suppressed = %d, want %d", digest[0].Suppressed, tt.wantSuppressed)
+			}
+		})
+	}
+}
+
+func TestRecord_RateLimitPerFingerprint(t *testing.T) {
+	r := New(Options{Burst: 1})
+	defer r.Close()
+
+	now := time.Now()
+	if !r.record(Report{Fingerprint: "a", Time: now}) {
+		t.Error("first a was suppressed")
+	}
+	if r.record(Report{Fingerprint: "a", Time: now}) {
+		t.Error("second a was let through")
+	}
+	if !r.record(Report{Fingerprint: "b", Time: now}) {
+		t.Error("first b was suppressed by the errors of a")
+	}
+}
+
+func TestRecord_MaxGroups(t *testing.T) {
+	tests := []struct {
+		name         string
+		fingerprints []string
+		want         map[string]int
+	}{
+		{"under the limit", []string{"a", "b", "a"}, map[string]int{"a": 2, "b": 1}},
+		{"at the limit", []string{"a", "b", "c"}, map[string]int{"a": 1, "b": 1, "c": 1}},
+		{"overflow", []string{"a", "b", "c", "d", "e", "d"}, map[string]int{"a": 1, "b": 1, "c": 1, otherFingerprint: 3}},
+		{"known groups after the overflow", []string{"a", "b", "c", "d", "a"}, map[string]int{"a": 2, "b": 1, "c": 1, otherFingerprint: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(Options{MaxGroups: 3, Burst: 100})
+			defer r.Close()
+
+			for _, f := range tt.fingerprints {
+				r.record(Report{Fingerprint: f, Message: "error " + f, Stack: "stack " + f, Time: time.Now()})
+			}
+
+			got := make(map[string]int)
+			for _, g := range r.Digest() {
+				got[g.Fingerprint] = g.Count
+				if g.Fingerprint == otherFingerprint && g.Stack != "" {
+					t.Errorf("other group has the stack %q", g.Stack)
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("groups = %v, want %v", got, tt.want)
+			}
+			for f, n := range tt.want {
+				if got[f] != n {
+					t.Errorf("groups = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDigest(t *testing.T) {
+	r := New(Options{Burst: 100})
+	defer r.Close()
+
+	start := time.Now()
+	for i, f := range []string{"a", "b", "c", "b", "c"} {
+		r.record(Report{Fingerprint: f, Time: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	digest := r.Digest()
+	var order []string
+	for _, g := range digest {
+		order = append(order, g.Fingerprint)
+	}
+	//the most frequent first, then the oldest
+	if got := strings.Join(order, ","); got != "b,c,a" {
+		t.Errorf("order = %s, want b,c,a", got)
+	}
+
+	if digest := r.Digest(); len(digest) != 0 {
+		t.Errorf("second digest has %d groups, want none", len(digest))
+	}
+}
+
+func TestRestore(t *testing.T) {
+	r := New(Options{Burst: 1, MaxGroups: 2})
+	defer r.Close()
+
+	start := time.Now()
+	r.record(Report{Fingerprint: "a", Message: "first a", Time: start})
+	r.record(Report{Fingerprint: "a", Message: "second a", Time: start.Add(time.Second)})
+	r.record(Report{Fingerprint: "b", Message: "first b", Time: start.Add(2 * time.Second)})
+	digest := r.Digest()
+
+	//reported after the failed digest
+	r.record(Report{Fingerprint: "a", Message: "third a", Fields: map[string]string{"n": "3"}, Time: start.Add(3 * time.Second)})
+	r.record(Report{Fingerprint: "c", Message: "first c", Time: start.Add(4 * time.Second)})
+
+	r.Restore(digest)
+
+	got := make(map[string]Group)
+	for _, g := range r.Digest() {
+		got[g.Fingerprint] = g
+	}
+
+	a := got["a"]
+	if a.Count != 3 || a.Suppressed != 2 {
+		t.Errorf("a: count = %d, suppressed = %d, want 3, 2", a.Count, a.Suppressed)
+	}
+	if a.Message != "first a" || !a.First.Equal(start) {
+		t.Errorf("a: message = %q, first = %v, want the ones of the restored group", a.Message, a.First)
+	}
+	if a.Fields["n"] != "3" || !a.Last.Equal(start.Add(3*time.Second)) {
+		t.Errorf("a: fields = %v, last = %v, want the ones of the newer error", a.Fields, a.Last)
+	}
+
+	if got["c"].Count != 1 {
+		t.Errorf("c: count = %d, want 1", got["c"].Count)
+	}
+	//no room left for b
+	if _, ok := got["b"]; ok {
+		t.Error("b was restored past MaxGroups")
+	}
+	if other := got[otherFingerprint]; other.Count != 1 || other.Stack != "" {
+		t.Errorf("other: count = %d, stack = %q, want 1, none", other.Count, other.Stack)
+	}
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process stand-in for an S3 compatible store, with what S3Store
+// uses of the API: buckets, and objects put, read, listed and removed. Requests
+// are path-style, like the ones minio-go sends to an endpoint that is not AWS.
+// Signatures are not checked.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+func (o fakeObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newFakeS3Store returns a store on a fakeS3 server, which is shut down with the test
+func newFakeS3Store(t *testing.T) *S3Store {
+	t.Helper()
+
+	server := httptest.NewServer(&fakeS3{buckets: make(map[string]map[string]fakeObject)})
+	t.Cleanup(server.Close)
+
+	store, err := NewS3Store(context.Background(), S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		AccessKey: "fake",
+		SecretKey: "fake-secret",
+		Bucket:    "gosub-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if key == "" {
+		s.serveBucket(w, r, bucket)
+		return
+	}
+
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket, "")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readFakeS3Body(r)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody", bucket, key)
+			return
+		}
+		obj := fakeObject{data: data, contentType: r.Header.Get("Content-Type"), modTime: time.Now()}
+		objects[key] = obj
+		w.Header().Set("ETag", obj.etag())
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey", bucket, key)
+			return
+		}
+		w.Header().Set("ETag", obj.etag())
+		w.Header().Set("Content-Type", obj.contentType)
+		//the response overrides of a presigned GET
+		if v := r.URL.Query().Get("response-content-disposition"); v != "" {
+			w.Header().Set("Content-Disposition", v)
+		}
+		http.ServeContent(w, r, key, obj.modTime, bytes.NewReader(obj.data))
+	case http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented", bucket, key)
+	}
+}
+
+func (s *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	objects, exists := s.buckets[bucket]
+
+	switch {
+	case r.Method == http.MethodPut:
+		if !exists {
+			s.buckets[bucket] = make(map[string]fakeObject)
+		}
+	case !exists:
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket, "")
+	case r.Method == http.MethodHead:
+	case r.Method == http.MethodGet && query.Has("location"):
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+	case r.Method == http.MethodGet && query.Get("list-type") == "2":
+		writeFakeS3List(w, bucket, query.Get("prefix"), objects)
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented", bucket, "")
+	}
+}
+
+// writeFakeS3List answers a recursive ListObjectsV2, in one page
+func writeFakeS3List(w http.ResponseWriter, bucket, prefix string, objects map[string]fakeObject) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []content
+	}{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+
+	for key, obj := range objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         obj.etag(),
+			Size:         len(obj.data),
+			StorageClass: "STANDARD",
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// readFakeS3Body reads the object of a PUT. Over plain HTTP minio-go streams it
+// in signed chunks, "<hex size>;chunk-signature=<sig>\r\n<data>\r\n", ending with
+// an empty chunk and maybe trailers.
+func readFakeS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data bytes.Buffer
+	body := bufio.NewReader(r.Body)
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			break
+		}
+		if _, err = io.CopyN(&data, body, size); err != nil {
+			return nil, err
+		}
+		if _, err = body.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" && decoded != strconv.Itoa(data.Len()) {
+		return nil, fmt.Errorf("decoded length %s, got %d bytes", decoded, data.Len())
+	}
+
+	return data.Bytes(), nil
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code, bucket, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><BucketName>%s</BucketName><Key>%s</Key><RequestId>fake</RequestId></Error>`,
+		code, code, bucket, key)
+}
@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocalStore(t *testing.T) *LocalStore {
+	t.Helper()
+
+	store, err := NewLocalStore(t.TempDir(), "http://localhost:8000/files/", []byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestLocalStore(t *testing.T) {
+	testBlobStore(t, newTestLocalStore(t))
+}
+
+// testBlobStore runs the behaviour every BlobStore must have against store, which
+// has to be empty under the "test/" prefix
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	put := func(key, content string) {
+		t.Helper()
+		err := store.Put(ctx, key, strings.NewReader(content), int64(len(content)), "application/pdf")
+		if err != nil {
+			t.Fatalf("Put(%q) error = %v", key, err)
+		}
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		put("test/manuals/1_2.pdf", "first")
+
+		b, err := ReadAll(ctx, store, "test/manuals/1_2.pdf")
+		if err != nil || string(b) != "first" {
+			t.Fatalf("ReadAll() = %q, %v", b, err)
+		}
+
+		//replaced, not appended
+		put("test/manuals/1_2.pdf", "second version")
+		b, err = ReadAll(ctx, store, "test/manuals/1_2.pdf")
+		if err != nil || string(b) != "second version" {
+			t.Fatalf("ReadAll() after replacing = %q, %v", b, err)
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		put("test/invoices/7.pdf", "invoice")
+
+		info, err := store.Stat(ctx, "test/invoices/7.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "test/invoices/7.pdf" || info.Size != int64(len("invoice")) {
+			t.Errorf("Stat() = %+v", info)
+		}
+		if time.Since(info.ModTime) > time.Minute || time.Until(info.ModTime) > time.Minute {
+			t.Errorf("Stat() ModTime = %v, want about now", info.ModTime)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := store.Get(ctx, "test/missing.pdf"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get() error = %v, want ErrNotFound", err)
+		}
+		if _, err := store.Stat(ctx, "test/missing.pdf"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat() error = %v, want ErrNotFound", err)
+		}
+		if err := store.Delete(ctx, "test/missing.pdf"); err != nil {
+			t.Errorf("Delete() of a missing blob = %v", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		put("test/list/a/1.pdf", "1")
+		put("test/list/a/2.pdf", "22")
+		put("test/list/b/3.pdf", "333")
+
+		blobs, err := store.List(ctx, "test/list/a/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := blobKeys(blobs); strings.Join(got, ",") != "test/list/a/1.pdf,test/list/a/2.pdf" {
+			t.Errorf("List(a) = %v", got)
+		}
+
+		blobs, err = store.List(ctx, "test/list/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(blobs) != 3 {
+			t.Errorf("List() = %v, want 3 blobs", blobKeys(blobs))
+		}
+
+		blobs, err = store.List(ctx, "test/none/")
+		if err != nil || len(blobs) != 0 {
+			t.Errorf("List() of an empty prefix = %v, %v", blobKeys(blobs), err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		put("test/delete/1.pdf", "1")
+		put("test/delete/2.pdf", "2")
+
+		if err := store.Delete(ctx, "test/delete/1.pdf"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Stat(ctx, "test/delete/1.pdf"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat() after Delete() error = %v, want ErrNotFound", err)
+		}
+
+		if err := DeletePrefix(ctx, store, "test/delete/"); err != nil {
+			t.Fatal(err)
+		}
+		blobs, err := store.List(ctx, "test/delete/")
+		if err != nil || len(blobs) != 0 {
+			t.Errorf("List() after DeletePrefix() = %v, %v", blobKeys(blobs), err)
+		}
+	})
+
+	t.Run("size mismatch", func(t *testing.T) {
+		err := store.Put(ctx, "test/short.pdf", strings.NewReader("abc"), 10, "application/pdf")
+		if err == nil {
+			t.Error("Put() of fewer bytes than the size = nil error")
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		for _, key := range invalidKeys {
+			if err := store.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+				t.Errorf("Put(%q) = nil error", key)
+			}
+			if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%q) error = %v, want an invalid key", key, err)
+			}
+			if _, err := store.SignedURL(ctx, key, "x.pdf", time.Minute); err == nil {
+				t.Errorf("SignedURL(%q) = nil error", key)
+			}
+		}
+	})
+}
+
+func blobKeys(blobs []BlobInfo) []string {
+	keys := make([]string, 0, len(blobs))
+	for _, b := range blobs {
+		keys = append(keys, b.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var invalidKeys = []string{
+	"",
+	"/etc/passwd",
+	"../secret.pdf",
+	"manuals/../../secret.pdf",
+	"manuals/..",
+	"./manuals/1.pdf",
+	"manuals//1.pdf",
+	"manuals/",
+	`manuals\1.pdf`,
+	`..\secret.pdf`,
+}
+
+func TestCheckKey(t *testing.T) {
+	for _, key := range invalidKeys {
+		if err := checkKey(key); err == nil {
+			t.Errorf("checkKey(%q) = nil, want an error", key)
+		}
+	}
+
+	for _, key := range []string{"a.pdf", "manuals/1_2_abc.pdf", "exports/2024/01/user-1.zip", "a..b/c.pdf"} {
+		if err := checkKey(key); err != nil {
+			t.Errorf("checkKey(%q) = %v", key, err)
+		}
+	}
+}
+
+func TestLocalStore_PutOutsideDir(t *testing.T) {
+	store := newTestLocalStore(t)
+
+	err := store.Put(context.Background(), "../escaped.pdf", strings.NewReader("x"), 1, "application/pdf")
+	if err == nil {
+		t.Fatal("Put() outside of the store = nil error")
+	}
+	if _, err = os.Stat(filepath.Join(filepath.Dir(store.dir), "escaped.pdf")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file was written outside of the store: %v", err)
+	}
+}
+
+func TestLocalStore_ListSkipsUploads(t *testing.T) {
+	store := newTestLocalStore(t)
+
+	//an upload cut off halfway
+	if err := os.WriteFile(filepath.Join(store.dir, localUploadPrefix+"123"), []byte("half"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := store.List(context.Background(), "")
+	if err != nil || len(blobs) != 0 {
+		t.Errorf("List() = %v, %v, want no blobs", blobKeys(blobs), err)
+	}
+}
+
+func TestLocalStore_ServeHTTP(t *testing.T) {
+	store := newTestLocalStore(t)
+	ctx := context.Background()
+
+	content := []byte("%PDF-1.4 manual")
+	if err := store.Put(ctx, "manuals/1_2.pdf", bytes.NewReader(content), int64(len(content)), "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.StripPrefix("/files", store)
+
+	serve := func(link string) *httptest.ResponseRecorder {
+		t.Helper()
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+		return rr
+	}
+
+	signed := func(key, filename string, expiry time.Duration) string {
+		t.Helper()
+		link, err := store.SignedURL(ctx, key, filename, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link
+	}
+
+	//changes one query parameter of a link
+	tamper := func(link, param, value string) string {
+		t.Helper()
+		u, err := url.Parse(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set(param, value)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	t.Run("valid link", func(t *testing.T) {
+		link := signed("manuals/1_2.pdf", "Manual.pdf", time.Minute)
+		if !strings.HasPrefix(link, "http://localhost:8000/files/manuals/1_2.pdf?") {
+			t.Errorf("SignedURL() = %q", link)
+		}
+
+		rr := serve(link)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rr.Code)
+		}
+		if !bytes.Equal(rr.Body.Bytes(), content) {
+			t.Errorf("body = %q", rr.Body.String())
+		}
+		if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="Manual.pdf"` {
+			t.Errorf("Content-Disposition = %q", got)
+		}
+	})
+
+	t.Run("missing blob", func(t *testing.T) {
+		rr := serve(signed("manuals/9_9.pdf", "Manual.pdf", time.Minute))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", rr.Code)
+		}
+	})
+
+	link := signed("manuals/1_2.pdf", "Manual.pdf", time.Minute)
+	other := signed("manuals/1_2.pdf", "Other.pdf", time.Minute)
+
+	forbidden := []struct {
+		name string
+		link string
+	}{
+		{"expired", signed("manuals/1_2.pdf", "Manual.pdf", -time.Minute)},
+		{"tampered sig", tamper(link, "sig", strings.Repeat("0", 64))},
+		{"sig of another name", tamper(link, "sig", mustQuery(t, other, "sig"))},
+		{"tampered name", tamper(link, "name", "Other.pdf")},
+		{"tampered expiry", tamper(link, "expires", "99999999999")},
+		{"no signature", strings.Split(link, "?")[0]},
+		{"another key", strings.Replace(link, "manuals/1_2.pdf", "manuals/1_3.pdf", 1)},
+	}
+
+	for _, tt := range forbidden {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(tt.link)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want 403", rr.Code)
+			}
+			if bytes.Contains(rr.Body.Bytes(), content) {
+				t.Error("the blob was served")
+			}
+		})
+	}
+
+	t.Run("error page", func(t *testing.T) {
+		var gotStatus int
+		var gotMessage string
+		store.ErrorPage = func(w http.ResponseWriter, r *http.Request, status int, message string) {
+			gotStatus, gotMessage = status, message
+			w.WriteHeader(status)
+		}
+		defer func() { store.ErrorPage = nil }()
+
+		rr := serve(signed("manuals/1_2.pdf", "Manual.pdf", -time.Minute))
+		if rr.Code != http.StatusForbidden || gotStatus != http.StatusForbidden || gotMessage == "" {
+			t.Errorf("status = %d, ErrorPage(%d, %q), want 403 with a message", rr.Code, gotStatus, gotMessage)
+		}
+
+		rr = serve(signed("manuals/9_9.pdf", "Manual.pdf", time.Minute))
+		if rr.Code != http.StatusNotFound || gotStatus != http.StatusNotFound {
+			t.Errorf("status = %d, ErrorPage(%d, %q), want 404", rr.Code, gotStatus, gotMessage)
+		}
+	})
+}
+
+func mustQuery(t *testing.T, link, param string) string {
+	t.Helper()
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Query().Get(param)
+}
+
+// make sure a blob read while another Put replaces it is either version
+func TestLocalStore_PutIsAtomic(t *testing.T) {
+	store := newTestLocalStore(t)
+	ctx := context.Background()
+
+	old := strings.Repeat("a", 1<<16)
+	if err := store.Put(ctx, "big.pdf", strings.NewReader(old), int64(len(old)), "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Put(ctx, "big.pdf", r, 2<<16, "application/pdf")
+	}()
+
+	//half of the new version is written
+	if _, err := w.Write(bytes.Repeat([]byte("b"), 1<<16)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ReadAll(ctx, store, "big.pdf")
+	if err != nil || string(b) != old {
+		t.Errorf("blob read during Put() is not the old version (%d bytes, %v)", len(b), err)
+	}
+
+	w.Write(bytes.Repeat([]byte("b"), 1<<16))
+	w.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Stat(ctx, "big.pdf")
+	if err != nil || info.Size != 2<<16 {
+		t.Errorf("Stat() after Put() = %+v, %v", info, err)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestS3Store connects to the store in S3_ENDPOINT, like the MinIO service of
+// docker-compose.yml, and skips the test when it is not set. The other tests run
+// against fakeS3. The blobs under
+// "test/" are removed before and after.
+func newTestS3Store(t *testing.T) *S3Store {
+	t.Helper()
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_ENDPOINT is not set, e.g. localhost:9000 for the MinIO service")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store, err := NewS3Store(ctx, S3Config{
+		Endpoint:  endpoint,
+		AccessKey: envOr("S3_ACCESS_KEY", "minio"),
+		SecretKey: envOr("S3_SECRET_KEY", "password"),
+		Bucket:    envOr("S3_BUCKET", "gosub-test"),
+		Region:    os.Getenv("S3_REGION"),
+		UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clean := func() {
+		if err := DeletePrefix(context.Background(), store, "test/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clean()
+	t.Cleanup(clean)
+
+	return store
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func TestS3Store(t *testing.T) {
+	testBlobStore(t, newFakeS3Store(t))
+}
+
+func TestS3Store_SignedURL(t *testing.T) {
+	testS3SignedURL(t, newFakeS3Store(t), false)
+}
+
+// the same against a real store, which checks the signatures too
+func TestS3Store_MinIO(t *testing.T) {
+	store := newTestS3Store(t)
+
+	testBlobStore(t, store)
+	t.Run("signed URL", func(t *testing.T) {
+		testS3SignedURL(t, store, true)
+	})
+}
+
+func testS3SignedURL(t *testing.T, store *S3Store, checksSignatures bool) {
+	ctx := context.Background()
+
+	content := "%PDF-1.4 invoice"
+	if err := store.Put(ctx, "test/invoices/7.pdf", strings.NewReader(content), int64(len(content)), "application/pdf"); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := store.SignedURL(ctx, "test/invoices/7.pdf", "Invoice 7.pdf", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(b) != content {
+		t.Fatalf("GET signed URL = %d %q", resp.StatusCode, b)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="Invoice 7.pdf"` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+
+	if !checksSignatures {
+		return
+	}
+
+	//the signature covers the file name
+	resp, err = http.Get(strings.Replace(link, "Invoice", "Other", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET tampered signed URL = %d, want 403", resp.StatusCode)
+	}
+}
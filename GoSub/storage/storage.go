@@ -0,0 +1,80 @@
+// Package storage keeps generated files, like manuals and invoices, in a blob
+// store, so they are not tied to the disk of the host that made them.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when there is no blob under a key
+var ErrNotFound = errors.New("storage: blob not found")
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores blobs under slash separated keys, like "manuals/1_2_abc.pdf"
+type BlobStore interface {
+	// Put stores the size bytes read from r under key, replacing what was there.
+	// Readers never see a half written blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob under key. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat describes the blob under key
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	// Delete removes the blob under key. A missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+	// List describes every blob whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+	// SignedURL returns a link that downloads the blob as filename, without a
+	// session, until expiry has passed
+	SignedURL(ctx context.Context, key, filename string, expiry time.Duration) (string, error)
+}
+
+// ReadAll reads the whole blob under key
+func ReadAll(ctx context.Context, store BlobStore, key string) ([]byte, error) {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// DeletePrefix removes every blob whose key starts with prefix
+func DeletePrefix(ctx context.Context, store BlobStore, prefix string) error {
+	blobs, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if err = store.Delete(ctx, blob.Key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkKey rejects keys that could point outside of the store
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("storage: invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("storage: invalid key %q", key)
+		}
+	}
+	return nil
+}
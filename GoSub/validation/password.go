@@ -0,0 +1,281 @@
+package validation
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes what a password has to look like
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	DisallowEmail bool
+	Breached      *BreachedList
+}
+
+// PasswordError is returned when a password does not satisfy the policy
+type PasswordError struct {
+	Problems []string
+}
+
+func (e *PasswordError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Problems, ", ")
+}
+
+// Message returns the problems as one sentence that can be shown to the user
+func (e *PasswordError) Message() string {
+	return "Password " + strings.Join(e.Problems, ", ")
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing is configured
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength:     8,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		DisallowEmail: true,
+	}
+}
+
+// Check returns a *PasswordError listing every rule the password breaks, or nil
+func (p *PasswordPolicy) Check(password, email string) error {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireUpper && !upper {
+		problems = append(problems, "must contain an upper case letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "must contain a lower case letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "must contain a symbol")
+	}
+
+	if p.DisallowEmail && containsEmail(password, email) {
+		problems = append(problems, "cannot contain your email address")
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		problems = append(problems, "has appeared in a data breach, please choose another one")
+	}
+
+	if len(problems) > 0 {
+		return &PasswordError{Problems: problems}
+	}
+	return nil
+}
+
+// containsEmail checks for the whole address and for the part before the @,
+// as long as that part is long enough to mean something
+func containsEmail(password, email string) bool {
+	password = strings.ToLower(password)
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return false
+	}
+
+	if strings.Contains(password, email) {
+		return true
+	}
+
+	local, _, _ := strings.Cut(email, "@")
+	return len(local) >= 3 && strings.Contains(password, local)
+}
+
+// Password checks a field against the policy
+func (f *Form) Password(field string, policy *PasswordPolicy, email string) {
+	if !f.Has(field) {
+		return
+	}
+
+	if err := policy.Check(f.Get(field), email); err != nil {
+		f.Errors.Add(field, err.(*PasswordError).Message())
+	}
+}
+
+// maxBreachedLine bounds the lines of the breached list, a hash with a count is
+// far shorter
+const maxBreachedLine = 256
+
+// BreachedList is an offline list of SHA-1 hashes of breached passwords. The
+// file stays on disk and is binary searched, so it can be as large as the whole
+// Pwned Passwords list without being held in memory.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// LoadBreachedList opens a file with one hex encoded SHA-1 hash per line, sorted
+// by hash. Lines in the "HASH:COUNT" format of the Pwned Passwords downloads
+// ordered by hash are accepted too.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	list := &BreachedList{file: file, size: info.Size()}
+
+	//catch a file of another format before it silently matches nothing
+	if list.size > 0 {
+		line, _, err := list.lineFrom(0)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, ok := lineHash(line); !ok {
+			file.Close()
+			return nil, fmt.Errorf("%s: not a list of SHA-1 hashes", path)
+		}
+	}
+
+	return list, nil
+}
+
+// Size returns the size of the list file in bytes
+func (b *BreachedList) Size() int64 {
+	return b.size
+}
+
+// Close closes the list file
+func (b *BreachedList) Close() error {
+	return b.file.Close()
+}
+
+// Contains returns true if the password is in the list. A list that cannot be
+// read does not block the password, the check is only advisory.
+func (b *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := sum[:]
+
+	//search the offsets of the file for the line of the hash
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, err := b.lineStart(mid)
+		if err != nil {
+			return false
+		}
+		if start >= b.size {
+			//no line starts after mid
+			hi = mid
+			continue
+		}
+
+		line, next, err := b.lineFrom(start)
+		if err != nil {
+			return false
+		}
+
+		got, ok := lineHash(line)
+		switch cmp := bytes.Compare(got[:], hash); {
+		case ok && cmp == 0:
+			return true
+		case !ok || cmp < 0:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+
+	return false
+}
+
+// lineStart returns the offset of the first line starting at or after off
+func (b *BreachedList) lineStart(off int64) (int64, error) {
+	if off == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, maxBreachedLine)
+	n, err := b.file.ReadAt(buf, off-1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	i := bytes.IndexByte(buf[:n], '\n')
+	if i < 0 {
+		if off-1+int64(n) >= b.size {
+			return b.size, nil
+		}
+		return 0, errBreachedLine
+	}
+
+	return off + int64(i), nil
+}
+
+// lineFrom returns the line starting at off, and the offset of the next one
+func (b *BreachedList) lineFrom(off int64) ([]byte, int64, error) {
+	buf := make([]byte, maxBreachedLine)
+	n, err := b.file.ReadAt(buf, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, 0, err
+	}
+
+	line := buf[:n]
+	i := bytes.IndexByte(line, '\n')
+	if i < 0 {
+		if off+int64(n) < b.size {
+			return nil, 0, errBreachedLine
+		}
+		//the last line, without a newline
+		return line, b.size, nil
+	}
+
+	return line[:i], off + int64(i) + 1, nil
+}
+
+var errBreachedLine = errors.New("validation: breached list line too long")
+
+// lineHash decodes the hash at the start of a line, before the count if any
+func lineHash(line []byte) ([sha1.Size]byte, bool) {
+	var hash [sha1.Size]byte
+
+	line, _, _ = bytes.Cut(bytes.TrimSpace(line), []byte(":"))
+	if len(line) != hex.EncodedLen(sha1.Size) {
+		return hash, false
+	}
+
+	_, err := hex.Decode(hash[:], line)
+	return hash, err == nil
+}
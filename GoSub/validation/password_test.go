@@ -0,0 +1,236 @@
+package validation
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	all := &PasswordPolicy{
+		MinLength:     8,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		DisallowEmail: true,
+	}
+
+	tests := []struct {
+		name     string
+		policy   *PasswordPolicy
+		password string
+		email    string
+		want     []string
+	}{
+		{"valid", all, "Correct-Horse7", "user@example.com", nil},
+		{"empty", all, "", "user@example.com", []string{
+			"must be at least 8 characters long",
+			"must contain an upper case letter",
+			"must contain a lower case letter",
+			"must contain a digit",
+			"must contain a symbol",
+		}},
+		{"too short", all, "Ab1-", "", []string{"must be at least 8 characters long"}},
+		{"length in runes", all, "Äb1-ééé", "", []string{"must be at least 8 characters long"}},
+		{"no upper", all, "correct-horse7", "", []string{"must contain an upper case letter"}},
+		{"no lower", all, "CORRECT-HORSE7", "", []string{"must contain a lower case letter"}},
+		{"no digit", all, "Correct-Horse", "", []string{"must contain a digit"}},
+		{"no symbol", all, "CorrectHorse7", "", []string{"must contain a symbol"}},
+		{"contains email", all, "X1-User@Example.com", "user@example.com", []string{"cannot contain your email address"}},
+		{"contains local part", all, "Xjohnny-1", "johnny@example.com", []string{"cannot contain your email address"}},
+		{"short local part ignored", all, "Xjo-12345", "jo@example.com", nil},
+		{"email allowed", &PasswordPolicy{MinLength: 1}, "user@example.com", "user@example.com", nil},
+		{"default policy", DefaultPasswordPolicy(), "Password1", "user@example.com", nil},
+		{"default policy needs no symbol", DefaultPasswordPolicy(), "password", "", []string{
+			"must contain an upper case letter",
+			"must contain a digit",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(tt.password, tt.email)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Check() = %v, want nil", err)
+				}
+				return
+			}
+
+			var perr *PasswordError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Check() = %v, want a *PasswordError", err)
+			}
+			if !reflect.DeepEqual(perr.Problems, tt.want) {
+				t.Errorf("problems = %q, want %q", perr.Problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicy_CheckBreached(t *testing.T) {
+	policy := &PasswordPolicy{Breached: writeBreachedList(t, pwnedFormat, "Password1")}
+
+	err := policy.Check("Password1", "")
+	var perr *PasswordError
+	if !errors.As(err, &perr) || len(perr.Problems) != 1 || !strings.Contains(perr.Problems[0], "data breach") {
+		t.Errorf("Check() of a breached password = %v", err)
+	}
+
+	if err = policy.Check("Password2", ""); err != nil {
+		t.Errorf("Check() of another password = %v", err)
+	}
+}
+
+func TestForm_Password(t *testing.T) {
+	f := New(map[string][]string{"password": {"short"}})
+	f.Password("password", DefaultPasswordPolicy(), "")
+
+	if got := f.Errors.Get("password"); !strings.HasPrefix(got, "Password must be at least 8 characters long") {
+		t.Errorf("error = %q", got)
+	}
+
+	f = New(nil)
+	f.Password("password", DefaultPasswordPolicy(), "")
+	if !f.Valid() {
+		t.Errorf("a blank field is left to Required, got %v", f.Errors)
+	}
+}
+
+// the formats a breached list can be written in
+var (
+	pwnedFormat = func(hash string, i int) string { return fmt.Sprintf("%s:%d\r\n", strings.ToUpper(hash), i+1) }
+	plainFormat = func(hash string, _ int) string { return hash + "\n" }
+)
+
+// writeBreachedList writes the hashes of the passwords among many others,
+// sorted by hash, and opens the list
+func writeBreachedList(t *testing.T, format func(hash string, i int) string, passwords ...string) *BreachedList {
+	t.Helper()
+
+	var hashes []string
+	for _, p := range passwords {
+		hashes = append(hashes, sha1Hex(p))
+	}
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, sha1Hex(fmt.Sprintf("filler-%d", i)))
+	}
+	sort.Strings(hashes)
+
+	var b strings.Builder
+	for i, h := range hashes {
+		b.WriteString(format(h, i))
+	}
+
+	list, err := LoadBreachedList(writeFile(t, b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { list.Close() })
+
+	return list
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBreachedList_Contains(t *testing.T) {
+	breached := []string{"password", "letmein", "Summer2024!", "Tr0ub4dor&3"}
+
+	formats := map[string]func(string, int) string{
+		"pwned": pwnedFormat,
+		"plain": plainFormat,
+	}
+
+	for name, format := range formats {
+		t.Run(name, func(t *testing.T) {
+			list := writeBreachedList(t, format, breached...)
+
+			for _, p := range breached {
+				if !list.Contains(p) {
+					t.Errorf("Contains(%q) = false, want true", p)
+				}
+			}
+			for i := 0; i < 1000; i += 97 {
+				if p := fmt.Sprintf("filler-%d", i); !list.Contains(p) {
+					t.Errorf("Contains(%q) = false, want true", p)
+				}
+			}
+			for _, p := range []string{"", "Password", "correct horse battery staple", "filler-1000"} {
+				if list.Contains(p) {
+					t.Errorf("Contains(%q) = true, want false", p)
+				}
+			}
+		})
+	}
+}
+
+func TestBreachedList_Edges(t *testing.T) {
+	first, last := sha1Hex("first"), sha1Hex("last")
+	if first > last {
+		first, last = last, first
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		in      []string
+		out     []string
+	}{
+		{"empty", "", nil, []string{"first"}},
+		{"one line", sha1Hex("first"), []string{"first"}, []string{"last"}},
+		{"no trailing newline", first + "\n" + last, []string{"first", "last"}, []string{"other"}},
+		{"trailing blank line", first + "\n" + last + "\n\n", []string{"first", "last"}, []string{"other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := LoadBreachedList(writeFile(t, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer list.Close()
+
+			for _, p := range tt.in {
+				if !list.Contains(p) {
+					t.Errorf("Contains(%q) = false, want true", p)
+				}
+			}
+			for _, p := range tt.out {
+				if list.Contains(p) {
+					t.Errorf("Contains(%q) = true, want false", p)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBreachedList_Invalid(t *testing.T) {
+	if _, err := LoadBreachedList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("LoadBreachedList() of a missing file = nil error")
+	}
+
+	if _, err := LoadBreachedList(writeFile(t, "password\nletmein\n")); err == nil {
+		t.Error("LoadBreachedList() of plain passwords = nil error")
+	}
+}
@@ -0,0 +1,97 @@
+// Package validation checks submitted form values and collects the
+// problems it finds per field, so they can be shown next to each input.
+package validation
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// EmailRX is the pattern browsers use for input type="email"
+var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// Errors holds the error messages of a form, by field name
+type Errors map[string][]string
+
+// Add adds an error message for the given field
+func (e Errors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Get returns the first error message for the given field, or an empty string
+func (e Errors) Get(field string) string {
+	messages := e[field]
+	if len(messages) == 0 {
+		return ""
+	}
+	return messages[0]
+}
+
+// Form wraps the submitted values together with the errors found in them
+type Form struct {
+	url.Values
+	Errors Errors
+}
+
+// New returns a form for the given values. A nil value gives an empty form,
+// which templates can use when nothing was submitted yet.
+func New(data url.Values) *Form {
+	if data == nil {
+		data = url.Values{}
+	}
+
+	return &Form{
+		Values: data,
+		Errors: Errors{},
+	}
+}
+
+// Valid returns true if no errors were added
+func (f *Form) Valid() bool {
+	return len(f.Errors) == 0
+}
+
+// Has returns true if the field was submitted with a non blank value
+func (f *Form) Has(field string) bool {
+	return strings.TrimSpace(f.Get(field)) != ""
+}
+
+// Required checks that all the given fields are not blank
+func (f *Form) Required(fields ...string) {
+	for _, field := range fields {
+		if !f.Has(field) {
+			f.Errors.Add(field, "This field cannot be blank")
+		}
+	}
+}
+
+// MinLength checks that a field is at least n characters long
+func (f *Form) MinLength(field string, n int) {
+	if f.Has(field) && utf8.RuneCountInString(f.Get(field)) < n {
+		f.Errors.Add(field, fmt.Sprintf("This field must be at least %d characters long", n))
+	}
+}
+
+// MaxLength checks that a field is at most n characters long
+func (f *Form) MaxLength(field string, n int) {
+	if utf8.RuneCountInString(f.Get(field)) > n {
+		f.Errors.Add(field, fmt.Sprintf("This field cannot be more than %d characters long", n))
+	}
+}
+
+// IsEmail checks that a field holds a valid email address
+func (f *Form) IsEmail(field string) {
+	if f.Has(field) && !EmailRX.MatchString(strings.TrimSpace(f.Get(field))) {
+		f.Errors.Add(field, "Invalid email address")
+	}
+}
+
+// Matches checks that two fields hold the same value, and adds the error to the second one
+func (f *Form) Matches(field, other, message string) {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(other, message)
+	}
+}
@@ -0,0 +1,123 @@
+package validation
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestForm_Required(t *testing.T) {
+	tests := []struct {
+		name   string
+		values url.Values
+		want   Errors
+	}{
+		{"all present", url.Values{"email": {"a@b.com"}, "password": {"secret"}}, Errors{}},
+		{"missing", url.Values{"email": {"a@b.com"}}, Errors{"password": {"This field cannot be blank"}}},
+		{"blank", url.Values{"email": {"   "}, "password": {"secret"}}, Errors{"email": {"This field cannot be blank"}}},
+		{"nothing submitted", nil, Errors{
+			"email":    {"This field cannot be blank"},
+			"password": {"This field cannot be blank"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(tt.values)
+			f.Required("email", "password")
+
+			if !reflect.DeepEqual(f.Errors, tt.want) {
+				t.Errorf("errors = %v, want %v", f.Errors, tt.want)
+			}
+			if f.Valid() != (len(tt.want) == 0) {
+				t.Errorf("Valid() = %v with errors %v", f.Valid(), f.Errors)
+			}
+		})
+	}
+}
+
+func TestForm_IsEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		valid bool
+	}{
+		{"user@example.com", true},
+		{"first.last+tag@sub.example.co.uk", true},
+		{"  user@example.com  ", true},
+		{"user@localhost", true},
+		{"", true}, //blank is left to Required
+		{"user", false},
+		{"user@", false},
+		{"@example.com", false},
+		{"user@@example.com", false},
+		{"user@-example.com", false},
+		{"user name@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			f := New(url.Values{"email": {tt.email}})
+			f.IsEmail("email")
+
+			if got := f.Errors.Get("email"); (got == "") != tt.valid {
+				t.Errorf("IsEmail(%q) error = %q, want valid %v", tt.email, got, tt.valid)
+			}
+			if !tt.valid && f.Errors.Get("email") != "Invalid email address" {
+				t.Errorf("IsEmail(%q) error = %q", tt.email, f.Errors.Get("email"))
+			}
+		})
+	}
+}
+
+func TestForm_Length(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"within", "abcdef", ""},
+		{"at min", "abcd", ""},
+		{"at max", "abcdefgh", ""},
+		{"too short", "abc", "This field must be at least 4 characters long"},
+		{"too long", "abcdefghi", "This field cannot be more than 8 characters long"},
+		{"runes not bytes", "ééééé", ""},
+		{"blank is left to Required", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(url.Values{"name": {tt.value}})
+			f.MinLength("name", 4)
+			f.MaxLength("name", 8)
+
+			if got := f.Errors.Get("name"); got != tt.want {
+				t.Errorf("error = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForm_Matches(t *testing.T) {
+	f := New(url.Values{"password": {"secret"}, "verify": {"other"}})
+	f.Matches("password", "verify", "Passwords do not match")
+
+	if got := f.Errors.Get("verify"); got != "Passwords do not match" {
+		t.Errorf("error = %q, want it on the second field", got)
+	}
+	if got := f.Errors.Get("password"); got != "" {
+		t.Errorf("error on the first field = %q", got)
+	}
+}
+
+func TestErrors_Get(t *testing.T) {
+	e := Errors{}
+	if got := e.Get("email"); got != "" {
+		t.Errorf("Get() on no errors = %q", got)
+	}
+
+	e.Add("email", "first")
+	e.Add("email", "second")
+	if got := e.Get("email"); got != "first" {
+		t.Errorf("Get() = %q, want the first message", got)
+	}
+}